@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rasky/g64drive/drive64"
+	"github.com/spf13/cobra"
+)
+
+var (
+	flagBenchSize = sizeUnit{4 * 1024 * 1024}
+	flagBenchSave bool
+)
+
+// Parameters tried by "g64drive bench"
+var (
+	benchChunkSizes    = []int{128 * 1024, 512 * 1024, 1024 * 1024, 2 * 1024 * 1024, 4 * 1024 * 1024}
+	benchLatencyTimers = []time.Duration{1 * time.Millisecond, 2 * time.Millisecond, 4 * time.Millisecond, 16 * time.Millisecond}
+)
+
+// Number of command roundtrips averaged to measure latency
+const benchRoundtrips = 32
+
+// linkProfilesPath returns the path of the file where the best link profile
+// of each device (as measured by "g64drive bench") is saved.
+func linkProfilesPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "g64drive", "linkprofiles.json"), nil
+}
+
+// loadLinkProfiles loads the saved link profiles, indexed by device serial.
+func loadLinkProfiles() (map[string]drive64.LinkProfile, error) {
+	profiles := make(map[string]drive64.LinkProfile)
+	path, err := linkProfilesPath()
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return profiles, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	return profiles, nil
+}
+
+func saveLinkProfile(serial string, p drive64.LinkProfile) error {
+	profiles, err := loadLinkProfiles()
+	if err != nil {
+		return err
+	}
+	profiles[serial] = p
+
+	path, err := linkProfilesPath()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(profiles, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0666)
+}
+
+// applyLinkProfile configures the device with the link profile saved by "g64drive bench", if any.
+func applyLinkProfile(dev *drive64.Device) {
+	profiles, err := loadLinkProfiles()
+	if err != nil {
+		vprintf("cannot load link profiles: %v\n", err)
+		return
+	}
+	if p, found := profiles[dev.Description().Serial]; found {
+		if err := dev.SetLinkProfile(p); err != nil {
+			vprintf("cannot apply link profile: %v\n", err)
+		}
+	}
+}
+
+type benchResult struct {
+	profile  drive64.LinkProfile
+	upload   float64 // bytes per second
+	download float64 // bytes per second
+	rtt      time.Duration
+}
+
+func benchProfile(ctx context.Context, dev *drive64.Device, p drive64.LinkProfile, data []byte) (benchResult, error) {
+	res := benchResult{profile: p}
+	if err := dev.SetLinkProfile(p); err != nil {
+		return res, err
+	}
+
+	t0 := time.Now()
+	if err := dev.CmdUpload(ctx, bytes.NewReader(data), int64(len(data)), drive64.BankCARTROM, 0); err != nil {
+		return res, err
+	}
+	res.upload = float64(len(data)) / time.Since(t0).Seconds()
+
+	var readback bytes.Buffer
+	t0 = time.Now()
+	if err := dev.CmdDownload(ctx, &readback, int64(len(data)), drive64.BankCARTROM, 0); err != nil {
+		return res, err
+	}
+	res.download = float64(len(data)) / time.Since(t0).Seconds()
+	if !bytes.Equal(readback.Bytes(), data) {
+		return res, errors.New("data read back does not match, the USB link is unreliable")
+	}
+
+	// Use raw version requests, because CmdVersionRequest is cached
+	var vers [8]byte
+	t0 = time.Now()
+	for i := 0; i < benchRoundtrips; i++ {
+		if err := dev.SendCmd(ctx, drive64.CmdVersionRequest, nil, nil, vers[:]); err != nil {
+			return res, err
+		}
+	}
+	res.rtt = time.Since(t0) / benchRoundtrips
+	return res, nil
+}
+
+func cmdBench(cmd *cobra.Command, args []string) error {
+	size := flagBenchSize.size
+	if size <= 0 || size%512 != 0 {
+		return usageErrorf("invalid size value (must be a positive multiple of 512)")
+	}
+
+	dev, err := openDevice()
+	if err != nil {
+		return err
+	}
+	defer dev.Close()
+	serial := dev.Description().Serial
+	vprintf("64drive serial: %v\n", serial)
+
+	// The benchmark transfers go to the beginning of CARTROM
+	vctx, cancel := cmdContext()
+	hwvar, _, _, err := dev.CmdVersionRequest(vctx)
+	cancel()
+	if err != nil {
+		return err
+	}
+	if err := drive64.BankCARTROM.Info().CheckRange(hwvar, 0, size); err != nil {
+		return err
+	}
+
+	// Deterministic pseudo-random data, so that compression or patterns
+	// in the USB stack don't affect the results
+	data := make([]byte, size)
+	rand.New(rand.NewSource(64)).Read(data)
+
+	return safeSigIntContext(func(ctx context.Context) error {
+		// The benchmark overwrites the beginning of CARTROM, so save it and
+		// restore it at the end.
+		vprintf("Saving CARTROM contents\n")
+		var backup bytes.Buffer
+		if err := dev.CmdDownload(ctx, &backup, size, drive64.BankCARTROM, 0); err != nil {
+			return err
+		}
+		var best *benchResult
+		defer func() {
+			vprintf("Restoring CARTROM contents\n")
+			if best != nil {
+				dev.SetLinkProfile(best.profile)
+			}
+			if err := dev.CmdUpload(context.Background(), &backup, size, drive64.BankCARTROM, 0); err != nil {
+				fmt.Fprintf(os.Stderr, "cannot restore CARTROM contents: %v\n", err)
+			}
+		}()
+
+		printf("%-10s %-10s %14s %14s %12s\n", "Latency", "Chunk", "Upload", "Download", "Roundtrip")
+		for _, lt := range benchLatencyTimers {
+			for _, cs := range benchChunkSizes {
+				res, err := benchProfile(ctx, dev, drive64.LinkProfile{ChunkSize: cs, LatencyTimer: lt}, data)
+				if err != nil {
+					return err
+				}
+				printf("%-10v %-10s %10.2f MB/s %10.2f MB/s %12v\n", lt, fmt.Sprintf("%d KiB", cs/1024),
+					res.upload/1e6, res.download/1e6, res.rtt.Round(time.Microsecond))
+				emit("bench", newJSONBench(&res))
+				if best == nil || res.upload+res.download > best.upload+best.download {
+					best = &res
+				}
+			}
+		}
+
+		printf("\nBest profile: latency %v, chunk %d KiB\n", best.profile.LatencyTimer, best.profile.ChunkSize/1024)
+		if flagBenchSave {
+			if err := saveLinkProfile(serial, best.profile); err != nil {
+				return err
+			}
+			printf("Profile saved for 64drive (serial: %v), it will be used by later transfers\n", serial)
+		}
+		res := newJSONBench(best)
+		res.Best, res.Saved = true, flagBenchSave
+		emit("bench", res)
+		return nil
+	})
+}
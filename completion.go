@@ -0,0 +1,128 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/rasky/g64drive/drive64"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// File extensions completed for arguments and flags that expect a ROM or a firmware file
+var (
+	romExtensions      = []string{"z64", "v64", "n64"}
+	firmwareExtensions = []string{"rpk"}
+)
+
+func bankNames() []string {
+	var names []string
+	for _, bi := range drive64.BankInfos {
+		names = append(names, bi.Name)
+	}
+	return names
+}
+
+func cicNames() []string {
+	names := []string{"auto"}
+	for _, cn := range drive64.CICNames {
+		names = append(names, cn.Name)
+	}
+	return names
+}
+
+func saveTypeNames() []string {
+	var names []string
+	for _, sn := range drive64.SaveTypeNames {
+		names = append(names, sn.Name)
+	}
+	return names
+}
+
+// commandByteNames returns the names of the 64drive commands accepted by "raw"
+func commandByteNames() []string {
+	var names []string
+	for _, c := range drive64.Cmds {
+		names = append(names, strings.TrimPrefix(c.String(), "Cmd"))
+	}
+	return names
+}
+
+func boolNames() []string {
+	return []string{"true", "false"}
+}
+
+// deviceSerials returns the serial numbers of the attached 64drive devices
+func deviceSerials() []string {
+	var serials []string
+	devices, _, _ := drive64.Enumerate()
+	for _, d := range devices {
+		serials = append(serials, d.Serial)
+	}
+	return serials
+}
+
+// flagCompletions lists the values that can be completed for flags, by flag name.
+// They are used for every command that has a flag with that name.
+var flagCompletions = map[string]func() []string{
+	"bank":     bankNames,
+	"cic":      cicNames,
+	"savetype": saveTypeNames,
+	"serial":   deviceSerials,
+}
+
+// flagFileCompletions lists the file extensions completed for flags, by flag name
+var flagFileCompletions = map[string][]string{
+	"rom": romExtensions,
+}
+
+// completeValues returns a completion function for the first argument of a
+// command, that must be one of the values returned by values.
+func completeValues(values func() []string) func(*cobra.Command, []string, string) ([]string, cobra.ShellCompDirective) {
+	return func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		if len(args) != 0 {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		}
+		var res []string
+		for _, v := range values() {
+			if strings.HasPrefix(v, toComplete) {
+				res = append(res, v)
+			}
+		}
+		return res, cobra.ShellCompDirectiveNoFileComp
+	}
+}
+
+// completeFiles returns a completion function for the first argument of a command,
+// that must be a file with one of the specified extensions.
+func completeFiles(exts []string) func(*cobra.Command, []string, string) ([]string, cobra.ShellCompDirective) {
+	return func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		if len(args) != 0 {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		}
+		return exts, cobra.ShellCompDirectiveFilterFileExt
+	}
+}
+
+// registerCompletions registers the dynamic completion of flag values
+// (see flagCompletions) for cmd and all its subcommands.
+func registerCompletions(cmd *cobra.Command) {
+	register := func(name string) {
+		if values, found := flagCompletions[name]; found {
+			if err := cmd.RegisterFlagCompletionFunc(name, func(*cobra.Command, []string, string) ([]string, cobra.ShellCompDirective) {
+				return values(), cobra.ShellCompDirectiveNoFileComp
+			}); err != nil {
+				panic(err)
+			}
+		} else if exts, found := flagFileCompletions[name]; found {
+			if err := cmd.MarkFlagFilename(name, exts...); err != nil {
+				panic(err)
+			}
+		}
+	}
+	// Only flags defined by this command: inherited ones are registered by the parent
+	cmd.LocalNonPersistentFlags().VisitAll(func(f *pflag.Flag) { register(f.Name) })
+	cmd.PersistentFlags().VisitAll(func(f *pflag.Flag) { register(f.Name) })
+	for _, c := range cmd.Commands() {
+		registerCompletions(c)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/spf13/cobra"
+)
+
+// Name of the per-project configuration file, searched in the current directory
+const localConfigName = "g64drive.toml"
+
+// Example of configuration file, shown in the help of "run"
+const configExample = `# Defaults for any command that has the flag
+[defaults]
+serial = "A1B2C3D4"
+wait = true
+
+# Defaults for a specific command (they win over the global ones)
+[defaults.upload]
+byteswap = 4
+
+[defaults."mem dump"]
+bank = "eeprom"
+
+# Launch profile, used with "g64drive run -p mygame"
+[profile.mygame]
+rom = "build/mygame.z64"      # relative paths are relative to the config file
+byteswap = 0                  # default: autodetect from the ROM header
+cic = "6102"                  # default: autodetect from the ROM header
+savetype = "eeprom4kbit"      # default: autodetect from the ROM database
+extended = false              # default: true for ROMs larger than 64 MiB
+save = "saves/mygame.eep"     # save memory to load (the "save slot")
+
+[[profile.mygame.patch]]
+file = "build/overlay.bin"
+offset = "0x10200000"         # offset or N64 PI address
+bank = "rom"`
+
+// config is the content of a configuration file.
+//
+// Defaults are flag values, by long flag name. Scalar values apply to every command
+// that has that flag, while tables (keyed by command, eg: "upload" or "mem dump")
+// apply only to that command.
+type config struct {
+	Defaults map[string]interface{} `toml:"defaults"`
+	Profiles map[string]*profile    `toml:"profile"`
+}
+
+// profile is a launch profile, used by "g64drive run"
+type profile struct {
+	Rom      string         `toml:"rom"`
+	ByteSwap *int           `toml:"byteswap"`
+	CIC      string         `toml:"cic"`
+	SaveType string         `toml:"savetype"`
+	Extended *bool          `toml:"extended"`
+	Save     string         `toml:"save"`
+	Patches  []profilePatch `toml:"patch"`
+
+	dir string // Directory of the configuration file, for relative paths
+}
+
+type profilePatch struct {
+	File   string `toml:"file"`
+	Offset string `toml:"offset"`
+	Bank   string `toml:"bank"`
+}
+
+// path resolves a path specified in the profile
+func (p *profile) path(fn string) string {
+	if fn == "" || filepath.IsAbs(fn) {
+		return fn
+	}
+	return filepath.Join(p.dir, fn)
+}
+
+// configPaths returns the configuration files, in order of precedence (lowest first)
+func configPaths() []string {
+	var paths []string
+	if dir, err := os.UserConfigDir(); err == nil {
+		paths = append(paths, filepath.Join(dir, "g64drive", "config.toml"))
+	}
+	return append(paths, localConfigName)
+}
+
+// loadConfigFile parses a configuration file. Missing files are not an error.
+func loadConfigFile(path string) (*config, error) {
+	var cfg config
+	md, err := toml.DecodeFile(path, &cfg)
+	if os.IsNotExist(err) {
+		return &cfg, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("%v: %w", path, err)
+	}
+	for _, key := range md.Undecoded() {
+		// Per-command defaults are decoded as generic tables, so they are
+		// reported as undecoded; they are validated by applyDefaults.
+		if key[0] != "defaults" {
+			return nil, fmt.Errorf("%v: unknown key %q", path, key.String())
+		}
+	}
+
+	dir, err := filepath.Abs(filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range cfg.Profiles {
+		p.dir = dir
+	}
+	return &cfg, nil
+}
+
+// loadConfig loads and merges all the configuration files. Defaults are merged
+// key by key, while profiles with the same name are replaced as a whole.
+func loadConfig() (*config, error) {
+	merged := &config{Defaults: map[string]interface{}{}, Profiles: map[string]*profile{}}
+	for _, path := range configPaths() {
+		cfg, err := loadConfigFile(path)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range cfg.Defaults {
+			if tbl, ok := v.(map[string]interface{}); ok {
+				if old, ok := merged.Defaults[k].(map[string]interface{}); ok {
+					for k2, v2 := range tbl {
+						old[k2] = v2
+					}
+					continue
+				}
+			}
+			merged.Defaults[k] = v
+		}
+		for name, p := range cfg.Profiles {
+			merged.Profiles[name] = p
+		}
+	}
+	return merged, nil
+}
+
+// Annotation of the flags set by applyDefaults (see flagOnCommandLine)
+const configDefaultAnnotation = "g64drive_config_default"
+
+// applyDefaults sets the flags of cmd that were not specified on the command line
+// to the defaults found in the configuration.
+func (cfg *config) applyDefaults(cmd *cobra.Command) error {
+	name := strings.TrimPrefix(cmd.CommandPath(), cmd.Root().Name()+" ")
+
+	set := func(flag string, val interface{}, strict bool) error {
+		f := cmd.Flags().Lookup(flag)
+		if f == nil {
+			if strict {
+				return fmt.Errorf("config: command %q has no flag --%v", name, flag)
+			}
+			return nil
+		}
+		if f.Changed {
+			return nil
+		}
+		if _, ok := val.(map[string]interface{}); ok {
+			return fmt.Errorf("config: invalid value for --%v", flag)
+		}
+		if err := cmd.Flags().Set(flag, fmt.Sprint(val)); err != nil {
+			return fmt.Errorf("config: --%v: %v", flag, err)
+		}
+		return cmd.Flags().SetAnnotation(flag, configDefaultAnnotation, []string{"true"})
+	}
+
+	// Command-specific defaults first: setting a flag marks it as changed,
+	// so the global defaults don't override them.
+	if tbl, ok := cfg.Defaults[name].(map[string]interface{}); ok {
+		for flag, val := range tbl {
+			if err := set(flag, val, true); err != nil {
+				return err
+			}
+		}
+	}
+	for flag, val := range cfg.Defaults {
+		if _, ok := val.(map[string]interface{}); ok {
+			continue
+		}
+		if err := set(flag, val, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flagOnCommandLine reports whether a flag of cmd was specified on the command
+// line. Unlike Changed, it is false for flags set to a default by applyDefaults.
+func flagOnCommandLine(cmd *cobra.Command, flag string) bool {
+	f := cmd.Flags().Lookup(flag)
+	return f != nil && f.Changed && f.Annotations[configDefaultAnnotation] == nil
+}
+
+// profile returns the launch profile with the specified name
+func (cfg *config) profile(name string) (*profile, error) {
+	if p, found := cfg.Profiles[name]; found {
+		return p, nil
+	}
+	if len(cfg.Profiles) == 0 {
+		return nil, errors.New("no profiles defined -- see \"g64drive run --help\"")
+	}
+	var names []string
+	for n := range cfg.Profiles {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return nil, fmt.Errorf("unknown profile %q (available: %v)", name, strings.Join(names, ", "))
+}
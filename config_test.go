@@ -0,0 +1,267 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/spf13/cobra"
+)
+
+// setenv sets an environment variable for the duration of the test
+func setenv(t *testing.T, key, value string) {
+	old, found := os.LookupEnv(key)
+	os.Setenv(key, value)
+	t.Cleanup(func() {
+		if found {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+// writeConfigs writes the user and the local configuration files, and moves
+// into the directory of the local one. It returns the two directories.
+func writeConfigs(t *testing.T, user, local string) (string, string) {
+	home := t.TempDir()
+	for _, key := range []string{"HOME", "XDG_CONFIG_HOME", "AppData"} {
+		setenv(t, key, home)
+	}
+	cfgdir, err := os.UserConfigDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	userdir := filepath.Join(cfgdir, "g64drive")
+	if err := os.MkdirAll(userdir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(userdir, "config.toml"), []byte(user), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	localdir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(localdir, localConfigName), []byte(local), 0600); err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(localdir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	// Compare resolved paths, as temporary directories may be symlinks
+	localdir, _ = filepath.Abs(".")
+	return userdir, localdir
+}
+
+func TestLoadConfig(t *testing.T) {
+	userdir, localdir := writeConfigs(t, `
+[defaults]
+serial = "A1B2C3D4"
+wait = true
+
+[defaults.upload]
+byteswap = 4
+bank = "rom"
+
+[profile.game]
+rom = "game.z64"
+cic = "6102"
+
+[profile.demo]
+rom = "demo.z64"
+`, `
+[defaults]
+serial = "E5F6A7B8"
+
+[defaults.upload]
+bank = "sram256"
+
+[defaults."mem dump"]
+bank = "eeprom"
+
+[profile.game]
+rom = "build/game.z64"
+`)
+
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Defaults are merged key by key, the local file wins
+	defaults := map[string]interface{}{
+		"serial":   "E5F6A7B8",
+		"wait":     true,
+		"upload":   map[string]interface{}{"byteswap": int64(4), "bank": "sram256"},
+		"mem dump": map[string]interface{}{"bank": "eeprom"},
+	}
+	if !reflect.DeepEqual(cfg.Defaults, defaults) {
+		t.Errorf("invalid defaults:\n%v\nexpected:\n%v", cfg.Defaults, defaults)
+	}
+
+	// Profiles are replaced as a whole, and their paths are relative to their file
+	game, err := cfg.profile("game")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if game.CIC != "" {
+		t.Errorf("profile was merged instead of replaced (cic: %q)", game.CIC)
+	}
+	if p := game.path(game.Rom); p != filepath.Join(localdir, "build", "game.z64") {
+		t.Errorf("invalid local profile path: %v", p)
+	}
+	demo, err := cfg.profile("demo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := demo.path(demo.Rom); p != filepath.Join(userdir, "demo.z64") {
+		t.Errorf("invalid user profile path: %v", p)
+	}
+
+	if _, err := cfg.profile("missing"); err == nil || !strings.Contains(err.Error(), "demo, game") {
+		t.Errorf("unexpected error for a missing profile: %v", err)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		local string
+		err   string
+	}{
+		{"unknown key", "[defaults]\nserial = \"A\"\n[extra]\nkey = 1\n", `unknown key "extra`},
+		{"unknown profile key", "[profile.game]\nrom = \"a.z64\"\nsavegame = \"a.eep\"\n", `unknown key "profile.game.savegame"`},
+		{"syntax error", "[defaults\n", localConfigName},
+	}
+	for _, tt := range tests {
+		writeConfigs(t, "", tt.local)
+		if _, err := loadConfig(); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: error is %v, expected %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+// newTestCommands returns a command tree with some of the flags of g64drive
+func newTestCommands() (root, upload, dump *cobra.Command) {
+	run := func(cmd *cobra.Command, args []string) {}
+	root = &cobra.Command{Use: "g64drive"}
+	upload = &cobra.Command{Use: "upload", Run: run}
+	upload.Flags().String("serial", "", "")
+	upload.Flags().Bool("wait", false, "")
+	upload.Flags().String("bank", "rom", "")
+	upload.Flags().Int("byteswap", 0, "")
+	mem := &cobra.Command{Use: "mem"}
+	dump = &cobra.Command{Use: "dump", Run: run}
+	dump.Flags().String("serial", "", "")
+	dump.Flags().String("bank", "rom", "")
+	mem.AddCommand(dump)
+	root.AddCommand(upload, mem)
+	return
+}
+
+func TestApplyDefaults(t *testing.T) {
+	tests := []struct {
+		name     string
+		defaults map[string]interface{}
+		dump     bool // test "mem dump" rather than "upload"
+		args     []string
+		flags    map[string]string
+		err      string
+	}{
+		{"global defaults",
+			map[string]interface{}{"serial": "A1B2C3D4", "wait": true, "cic": "6102"},
+			false, nil,
+			map[string]string{"serial": "A1B2C3D4", "wait": "true", "bank": "rom", "byteswap": "0"}, ""},
+		{"command defaults win over global ones",
+			map[string]interface{}{"bank": "sram256", "upload": map[string]interface{}{"bank": "eeprom", "byteswap": int64(4)}},
+			false, nil,
+			map[string]string{"bank": "eeprom", "byteswap": "4"}, ""},
+		{"command line wins over defaults",
+			map[string]interface{}{"serial": "A1B2C3D4", "upload": map[string]interface{}{"byteswap": int64(4)}},
+			false, []string{"--byteswap", "2", "--serial", "E5F6A7B8"},
+			map[string]string{"serial": "E5F6A7B8", "byteswap": "2"}, ""},
+		{"defaults of other commands are ignored",
+			map[string]interface{}{"mem dump": map[string]interface{}{"bank": "eeprom"}},
+			false, nil,
+			map[string]string{"bank": "rom"}, ""},
+		{"subcommand defaults",
+			map[string]interface{}{"bank": "sram256", "mem dump": map[string]interface{}{"bank": "eeprom"}},
+			true, nil,
+			map[string]string{"bank": "eeprom"}, ""},
+		{"unknown command flag",
+			map[string]interface{}{"upload": map[string]interface{}{"cic": "6102"}},
+			false, nil, nil, `command "upload" has no flag --cic`},
+		{"invalid value",
+			map[string]interface{}{"byteswap": "four"},
+			false, nil, nil, "config: --byteswap"},
+		{"table for a flag",
+			map[string]interface{}{"upload": map[string]interface{}{"bank": map[string]interface{}{"x": 1}}},
+			false, nil, nil, "invalid value for --bank"},
+	}
+	for _, tt := range tests {
+		_, upload, dump := newTestCommands()
+		cmd := upload
+		if tt.dump {
+			cmd = dump
+		}
+		if err := cmd.ParseFlags(tt.args); err != nil {
+			t.Fatal(err)
+		}
+
+		cfg := &config{Defaults: tt.defaults}
+		err := cfg.applyDefaults(cmd)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: error is %v, expected %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		for flag, val := range tt.flags {
+			if got := cmd.Flags().Lookup(flag).Value.String(); got != val {
+				t.Errorf("%s: --%v is %q, expected %q", tt.name, flag, got, val)
+			}
+		}
+	}
+}
+
+func TestFlagOnCommandLine(t *testing.T) {
+	_, upload, _ := newTestCommands()
+	if err := upload.ParseFlags([]string{"--byteswap", "2"}); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config{Defaults: map[string]interface{}{"serial": "A1B2C3D4", "byteswap": int64(4)}}
+	if err := cfg.applyDefaults(upload); err != nil {
+		t.Fatal(err)
+	}
+
+	// Flags set by the defaults are changed, but not specified on the command line
+	for flag, exp := range map[string]bool{"byteswap": true, "serial": false, "bank": false, "missing": false} {
+		if got := flagOnCommandLine(upload, flag); got != exp {
+			t.Errorf("--%v: on command line is %v, expected %v", flag, got, exp)
+		}
+	}
+	if !upload.Flags().Changed("serial") {
+		t.Errorf("--serial was not set by the defaults")
+	}
+
+	// The shell resets the flags between commands
+	resetFlags(upload)
+	if err := upload.ParseFlags([]string{"--serial", "E5F6A7B8"}); err != nil {
+		t.Fatal(err)
+	}
+	if !flagOnCommandLine(upload, "serial") {
+		t.Errorf("--serial is still marked as a default after resetFlags")
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rasky/g64drive/drive64"
+	"github.com/spf13/cobra"
+)
+
+// Result of a check performed by "g64drive doctor"
+const (
+	doctorOK   = "ok"
+	doctorInfo = "info"
+	doctorWarn = "warn"
+	doctorFail = "fail"
+)
+
+// doctorCheck is the result of a single diagnostic check. Hint suggests how
+// to fix the problem, and can span multiple lines.
+type doctorCheck struct {
+	Name   string
+	Status string
+	Detail string
+	Hint   string
+}
+
+func (c doctorCheck) print() {
+	if jsonOutput() {
+		emit("doctor", jsonDoctorCheck(c))
+		return
+	}
+	fmt.Printf("[%-4s] %v: %v\n", c.Status, c.Name, c.Detail)
+	for _, line := range strings.Split(c.Hint, "\n") {
+		if line != "" {
+			fmt.Printf("       %v\n", line)
+		}
+	}
+}
+
+func cmdDoctor(cmd *cobra.Command, args []string) error {
+	var checks []doctorCheck
+	add := func(c doctorCheck) {
+		c.print()
+		checks = append(checks, c)
+	}
+
+	// Enumeration goes through libftdi and libusb: if it works, both are usable
+	devs, err := drive64.EnumerateFTDI()
+	if err != nil {
+		add(doctorCheck{Name: "libusb/libftdi", Status: doctorFail, Detail: err.Error(),
+			Hint: "make sure that libusb is installed and working"})
+		return errors.New("USB devices cannot be enumerated")
+	}
+	add(doctorCheck{Name: "libusb/libftdi", Status: doctorOK, Detail: "USB enumeration works"})
+
+	if len(devs) == 0 {
+		add(doctorCheck{Name: "usb", Status: doctorFail, Detail: "no FTDI devices found",
+			Hint: "check the USB cable, and make sure that the 64drive is powered (the N64 must be on)"})
+	}
+	var found []drive64.DeviceDesc
+	for _, d := range devs {
+		c := doctorCheck{
+			Name: fmt.Sprintf("usb %04x:%04x", d.VendorID, d.ProductID),
+			Detail: fmt.Sprintf("manufacturer %q, description %q, serial %q",
+				d.Manufacturer, d.Description, d.Serial),
+		}
+		switch {
+		case d.Is64drive():
+			c.Status = doctorOK
+			found = append(found, d)
+		case d.Manufacturer == "" && d.Description == "" && d.Serial == "":
+			c.Status = doctorWarn
+			c.Hint = "the USB strings cannot be read: the device is not accessible (permissions or drivers?)"
+		default:
+			c.Status = doctorInfo
+			c.Detail += " (not a 64drive)"
+		}
+		add(c)
+	}
+
+	for _, c := range doctorPlatformChecks() {
+		add(c)
+	}
+
+	for _, d := range found {
+		name := fmt.Sprintf("64drive %v", d.Serial)
+		dev, err := d.Open()
+		if err != nil {
+			add(doctorCheck{Name: name, Status: doctorFail, Detail: fmt.Sprintf("cannot open: %v", err)})
+			continue
+		}
+		ctx, cancel := cmdContext()
+		t0 := time.Now()
+		hwver, fwver, _, err := dev.CmdVersionRequest(ctx)
+		elapsed := time.Since(t0)
+		cancel()
+		dev.Close()
+		if err != nil {
+			add(doctorCheck{Name: name, Status: doctorFail, Detail: fmt.Sprintf("version request failed: %v", err),
+				Hint: "try \"g64drive reset-link\", or power-cycle the 64drive"})
+			continue
+		}
+		add(doctorCheck{Name: name, Status: doctorOK,
+			Detail: fmt.Sprintf("%v, firmware %v, version request roundtrip: %v", hwver, fwver, elapsed.Round(time.Microsecond))})
+	}
+
+	failed := 0
+	for _, c := range checks {
+		if c.Status == doctorFail {
+			failed++
+		}
+	}
+	switch {
+	case len(found) == 0:
+		return drive64.ErrNoDevices
+	case failed > 0:
+		return fmt.Errorf("%d check(s) failed", failed)
+	}
+	return nil
+}
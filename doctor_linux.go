@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Suggested udev rule, to give access to 64drive to all users
+const udevRule = `SUBSYSTEM=="usb", ATTR{idVendor}=="0403", ATTR{manufacturer}=="Retroactive", MODE="0666"`
+
+// sysfsAttr reads an attribute of a USB device from sysfs
+func sysfsAttr(dir, name string) string {
+	data, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// doctorPlatformChecks inspects the FTDI devices through sysfs: the permissions
+// of their device nodes, and the kernel drivers bound to their interfaces.
+func doctorPlatformChecks() []doctorCheck {
+	var checks []doctorCheck
+	dirs, _ := filepath.Glob("/sys/bus/usb/devices/*")
+	for _, dir := range dirs {
+		if sysfsAttr(dir, "idVendor") != "0403" {
+			continue
+		}
+		name := fmt.Sprintf("usb %v:%v", sysfsAttr(dir, "idVendor"), sysfsAttr(dir, "idProduct"))
+		busnum, err1 := strconv.Atoi(sysfsAttr(dir, "busnum"))
+		devnum, err2 := strconv.Atoi(sysfsAttr(dir, "devnum"))
+		if err1 != nil || err2 != nil {
+			continue
+		}
+
+		node := fmt.Sprintf("/dev/bus/usb/%03d/%03d", busnum, devnum)
+		if err := unix.Access(node, unix.R_OK|unix.W_OK); err != nil {
+			checks = append(checks, doctorCheck{Name: name, Status: doctorFail,
+				Detail: fmt.Sprintf("%v is not accessible: %v", node, err),
+				Hint: fmt.Sprintf("run g64drive as root, or add this udev rule to /etc/udev/rules.d/99-64drive.rules:\n"+
+					"  %v\nthen run: sudo udevadm control --reload-rules && sudo udevadm trigger", udevRule)})
+		} else {
+			checks = append(checks, doctorCheck{Name: name, Status: doctorOK,
+				Detail: fmt.Sprintf("%v is accessible", node)})
+		}
+
+		// Interfaces are named after the device, eg: 1-2:1.0 for device 1-2
+		ifaces, _ := filepath.Glob(dir + ":*")
+		for _, iface := range ifaces {
+			driver, err := os.Readlink(filepath.Join(iface, "driver"))
+			if err != nil {
+				continue
+			}
+			driver = filepath.Base(driver)
+			c := doctorCheck{Name: name, Status: doctorInfo,
+				Detail: fmt.Sprintf("interface %v is claimed by kernel driver %v", filepath.Base(iface), driver)}
+			if driver == "ftdi_sio" {
+				c.Status = doctorWarn
+				c.Hint = "libftdi detaches ftdi_sio when opening the device; if that fails, run: sudo rmmod ftdi_sio"
+			}
+			checks = append(checks, c)
+		}
+	}
+	return checks
+}
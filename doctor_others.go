@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+// doctorPlatformChecks returns the checks specific to the operating system.
+// There are none, except on Linux.
+func doctorPlatformChecks() []doctorCheck {
+	return nil
+}
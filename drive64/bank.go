@@ -0,0 +1,119 @@
+package drive64
+
+import (
+	"fmt"
+)
+
+// BankInfo describes a 64drive memory bank: its size, the constraints on
+// transfers, and how it is mapped in the N64 address space.
+type BankInfo struct {
+	Bank         Bank
+	Name         string      // Short name, as used on the command line (eg: "sram256")
+	Size         int64       // Capacity in bytes
+	ExtendedSize int64       // Capacity in bytes in extended mode (HW2 only), if different from Size
+	Fixed        bool        // True if the bank holds a single fixed-size object (eg: a save memory)
+	Align        uint32      // Required alignment of transfer offsets
+	ByteSwap     ByteSwapper // Byteswap needed to convert the bank contents to big-endian format
+	PIBase       uint32      // Base N64 PI address the bank is mapped at (0: not mapped on PI)
+}
+
+// Base PI addresses of the N64 cartridge domains
+const (
+	piCartSaveBase uint32 = 0x08000000 // Cartridge Domain 2 Address 2 (SRAM, FlashRAM)
+	piCartROMBase  uint32 = 0x10000000 // Cartridge Domain 1 Address 2 (ROM)
+)
+
+// BankInfos contains the description of all banks supported by 64drive
+var BankInfos = []BankInfo{
+	{BankCARTROM, "rom", 64 * 1024 * 1024, 240 * 1024 * 1024, false, 4, BSNone, piCartROMBase},
+	{BankSRAM256, "sram256", 32 * 1024, 0, true, 4, BSNone, piCartSaveBase},
+	{BankSRAM768, "sram768", 96 * 1024, 0, true, 4, BSNone, piCartSaveBase},
+	{BankFLASH, "flash", 128 * 1024, 0, true, 4, BSNone, piCartSaveBase},
+	{BankFLASH_POKSTAD2, "flash_pokstad2", 128 * 1024, 0, true, 4, BSNone, piCartSaveBase},
+	{BankEEPROM, "eeprom", 2 * 1024, 0, true, 4, BSNone, 0},
+}
+
+// Info returns the description of the bank
+func (b Bank) Info() BankInfo {
+	for _, bi := range BankInfos {
+		if bi.Bank == b {
+			return bi
+		}
+	}
+	return BankInfo{Bank: b, Name: b.String(), Align: 4}
+}
+
+// NewBankFromString parses a bank name (eg: "sram256") and returns the
+// corresponding Bank, or an error if the name doesn't match any known bank.
+func NewBankFromString(name string) (Bank, error) {
+	for _, bi := range BankInfos {
+		if bi.Name == name {
+			return bi.Bank, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid bank: %v", name)
+}
+
+// Capacity returns the size of the bank on the specified hardware variant,
+// with extended mode enabled or not. Extended mode is only available on HW2.
+//
+// Extended mode only affects what is visible to the N64: USB transfers can
+// always access the whole SDRAM, so they must be checked with CheckRange.
+func (bi BankInfo) Capacity(hw Variant, extended bool) int64 {
+	if extended && hw != VarRevA && bi.ExtendedSize != 0 {
+		return bi.ExtendedSize
+	}
+	return bi.Size
+}
+
+// CheckRange verifies that a USB transfer of size bytes at the specified offset
+// is aligned and fits within the bank. As transfers are not affected by extended
+// mode, the whole SDRAM is accessible on HW2.
+func (bi BankInfo) CheckRange(hw Variant, offset uint32, size int64) error {
+	if bi.Align != 0 && offset%bi.Align != 0 {
+		return fmt.Errorf("offset 0x%x is not aligned to %d bytes", offset, bi.Align)
+	}
+	cp := bi.Capacity(hw, true)
+	if int64(offset) >= cp {
+		return fmt.Errorf("offset 0x%x is past the end of bank %v (0x%x)", offset, bi.Name, cp)
+	}
+	if int64(offset)+size > cp {
+		return fmt.Errorf("transfer (offset 0x%x, size 0x%x) exceeds the size of bank %v (0x%x)", offset, size, bi.Name, cp)
+	}
+	return nil
+}
+
+// TranslatePIAddress converts a N64 PI address (eg: 0x10001000) to the 64drive bank
+// and offset it is mapped to. Addresses in the ROM domain are always translated to
+// BankCARTROM; addresses in the SRAM/FlashRAM domain are translated only if bank
+// is one of the save banks mapped there, as the actual bank depends on the save type.
+// If addr is not a PI address, it is returned unchanged as an offset within bank.
+func TranslatePIAddress(addr uint32, bank Bank) (Bank, uint32) {
+	switch {
+	case addr >= piCartROMBase && addr < 0x1FC00000:
+		return BankCARTROM, addr - piCartROMBase
+	case addr >= piCartSaveBase && addr < piCartROMBase && bank.Info().PIBase == piCartSaveBase:
+		return bank, addr - piCartSaveBase
+	default:
+		return bank, addr
+	}
+}
+
+// Bank returns the bank that holds the save memory for the specified save type.
+// It returns false for SaveNone.
+func (st SaveType) Bank() (Bank, bool) {
+	switch st {
+	case SaveEeprom4Kbit, SaveEeprom16Kbit:
+		return BankEEPROM, true
+	case SaveSRAM256Kbit:
+		return BankSRAM256, true
+	case SaveSRAM768Kbit:
+		return BankSRAM768, true
+	case SaveFlashRAM1Mbit:
+		return BankFLASH, true
+	case SaveFlashRAM1Mbit_PokStad2:
+		return BankFLASH_POKSTAD2, true
+	default:
+		return 0, false
+	}
+}
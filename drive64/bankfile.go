@@ -0,0 +1,258 @@
+package drive64
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync"
+)
+
+// Size of the blocks used for bank transfers. Because of a 64drive firmware bug,
+// transfers must be multiple of 512 bytes, so reads and writes are performed on
+// whole blocks.
+const bankBlockSize = 512
+
+// Maximum number of blocks kept in the read cache of a BankFile
+const bankCacheBlocks = 256
+
+// BankFile gives random access to the contents of a 64drive bank. It implements
+// io.ReaderAt, io.WriterAt and io.ReadWriteSeeker on top of CmdDownload and CmdUpload,
+// so that standard library code can operate on live memory without downloading
+// the whole bank.
+//
+// Unaligned writes are handled with read-modify-write of the affected blocks.
+// Recently read blocks are cached; since the N64 can modify some banks (eg: save
+// memory) while it is running, use InvalidateCache to drop stale data.
+//
+// A BankFile is safe for concurrent use. Read, Write and Seek share the same
+// file position, like an os.File.
+type BankFile struct {
+	ctx  context.Context // used for all the transfers (see OpenBank)
+	dev  *Device
+	bank Bank
+	size int64
+
+	mu    sync.Mutex
+	cache map[int64][]byte // block index -> block data
+	lru   []int64          // cached block indices, oldest first
+
+	posMu sync.Mutex // held during Read, Write and Seek
+	pos   int64
+}
+
+// OpenBank returns a BankFile to access the specified bank. Since io.ReaderAt and
+// io.WriterAt have no context, ctx is kept by the BankFile and used for all its
+// transfers: once ctx is canceled or expires, all accesses fail.
+func (d *Device) OpenBank(ctx context.Context, bank Bank) (*BankFile, error) {
+	hwver, _, _, err := d.CmdVersionRequest(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// Extended mode doesn't affect USB transfers (see BankInfo.CheckRange)
+	return &BankFile{
+		ctx:   ctx,
+		dev:   d,
+		bank:  bank,
+		size:  bank.Info().Capacity(hwver, true),
+		cache: make(map[int64][]byte),
+	}, nil
+}
+
+// Size returns the size of the bank in bytes
+func (f *BankFile) Size() int64 {
+	return f.size
+}
+
+// InvalidateCache drops all cached blocks, so that the next reads
+// fetch fresh data from the device.
+func (f *BankFile) InvalidateCache() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.cache = make(map[int64][]byte)
+	f.lru = nil
+}
+
+// cacheBlock stores a copy of a block in the cache, so that the cache doesn't keep
+// alive the (possibly large) transfer buffer data comes from.
+func (f *BankFile) cacheBlock(idx int64, data []byte) {
+	if _, found := f.cache[idx]; !found {
+		if len(f.lru) >= bankCacheBlocks {
+			delete(f.cache, f.lru[0])
+			f.lru = f.lru[1:]
+		}
+		f.lru = append(f.lru, idx)
+	}
+	f.cache[idx] = append([]byte(nil), data[:bankBlockSize]...)
+}
+
+// dropBlocks removes blocks [first, last] from the cache. Must be called with f.mu held.
+func (f *BankFile) dropBlocks(first, last int64) {
+	lru := f.lru[:0]
+	for _, idx := range f.lru {
+		if idx >= first && idx <= last {
+			delete(f.cache, idx)
+		} else {
+			lru = append(lru, idx)
+		}
+	}
+	f.lru = lru
+}
+
+// readBlocks returns the contents of blocks [first, last], fetching the missing
+// ones from the device with a single transfer. Must be called with f.mu held.
+func (f *BankFile) readBlocks(first, last int64) ([]byte, error) {
+	out := make([]byte, (last-first+1)*bankBlockSize)
+
+	// Copy cached blocks, and find the range of blocks that must be fetched
+	lo, hi := int64(-1), int64(-1)
+	for idx := first; idx <= last; idx++ {
+		if blk, found := f.cache[idx]; found {
+			copy(out[(idx-first)*bankBlockSize:], blk)
+		} else {
+			if lo < 0 {
+				lo = idx
+			}
+			hi = idx
+		}
+	}
+
+	if lo >= 0 {
+		var buf bytes.Buffer
+		if err := f.dev.CmdDownload(f.ctx, &buf, (hi-lo+1)*bankBlockSize,
+			f.bank, uint32(lo*bankBlockSize)); err != nil {
+			return nil, err
+		}
+		data := buf.Bytes()
+		copy(out[(lo-first)*bankBlockSize:], data)
+		for idx := lo; idx <= hi; idx++ {
+			off := (idx - lo) * bankBlockSize
+			f.cacheBlock(idx, data[off:])
+		}
+	}
+
+	return out, nil
+}
+
+// ReadAt implements io.ReaderAt
+func (f *BankFile) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("BankFile.ReadAt: negative offset")
+	}
+	if off >= f.size {
+		return 0, io.EOF
+	}
+
+	var err error
+	if off+int64(len(p)) > f.size {
+		p = p[:f.size-off]
+		err = io.EOF
+	}
+	if len(p) == 0 {
+		return 0, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	first := off / bankBlockSize
+	data, rerr := f.readBlocks(first, (off+int64(len(p))-1)/bankBlockSize)
+	if rerr != nil {
+		return 0, rerr
+	}
+	return copy(p, data[off-first*bankBlockSize:]), err
+}
+
+// WriteAt implements io.WriterAt
+func (f *BankFile) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("BankFile.WriteAt: negative offset")
+	}
+	if off+int64(len(p)) > f.size {
+		return 0, errors.New("BankFile.WriteAt: write past the end of the bank")
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	first := off / bankBlockSize
+	last := (off + int64(len(p)) - 1) / bankBlockSize
+
+	// On failure, the device contents of the affected blocks are unknown
+	fail := func(err error) (int, error) {
+		f.dropBlocks(first, last)
+		return 0, err
+	}
+
+	// Read-modify-write partial blocks at the boundaries. Blocks in the middle
+	// are fully overwritten, so there's no need to read them.
+	data := make([]byte, (last-first+1)*bankBlockSize)
+	if off%bankBlockSize != 0 {
+		blk, err := f.readBlocks(first, first)
+		if err != nil {
+			return fail(err)
+		}
+		copy(data, blk)
+	}
+	if (off+int64(len(p)))%bankBlockSize != 0 {
+		blk, err := f.readBlocks(last, last)
+		if err != nil {
+			return fail(err)
+		}
+		copy(data[(last-first)*bankBlockSize:], blk)
+	}
+	copy(data[off-first*bankBlockSize:], p)
+
+	if err := f.dev.CmdUpload(f.ctx, bytes.NewReader(data), int64(len(data)),
+		f.bank, uint32(first*bankBlockSize)); err != nil {
+		return fail(err)
+	}
+
+	for idx := first; idx <= last; idx++ {
+		off := (idx - first) * bankBlockSize
+		f.cacheBlock(idx, data[off:])
+	}
+	return len(p), nil
+}
+
+// Read implements io.Reader
+func (f *BankFile) Read(p []byte) (int, error) {
+	f.posMu.Lock()
+	defer f.posMu.Unlock()
+	n, err := f.ReadAt(p, f.pos)
+	f.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Write implements io.Writer
+func (f *BankFile) Write(p []byte) (int, error) {
+	f.posMu.Lock()
+	defer f.posMu.Unlock()
+	n, err := f.WriteAt(p, f.pos)
+	f.pos += int64(n)
+	return n, err
+}
+
+// Seek implements io.Seeker
+func (f *BankFile) Seek(offset int64, whence int) (int64, error) {
+	f.posMu.Lock()
+	defer f.posMu.Unlock()
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += f.size
+	default:
+		return 0, errors.New("BankFile.Seek: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("BankFile.Seek: negative position")
+	}
+	f.pos = offset
+	return offset, nil
+}
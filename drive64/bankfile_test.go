@@ -0,0 +1,392 @@
+package drive64
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+// fakeDevice emulates the memory banks of a 64drive. It serves the commands
+// of a Device through the daemon protocol, so that no USB device is required.
+type fakeDevice struct {
+	mu        sync.Mutex
+	mem       map[Bank][]byte
+	downloads int
+	uploads   int
+
+	// fail, if set, makes a command fail with a protocol error
+	fail func(cmd Cmd, bank Bank, offset uint32) bool
+}
+
+// newFakeDevice returns a HW2 Device backed by a fakeDevice
+func newFakeDevice(t *testing.T) (*Device, *fakeDevice) {
+	fd := &fakeDevice{mem: make(map[Bank][]byte)}
+	for _, bi := range BankInfos {
+		fd.mem[bi.Bank] = make([]byte, bi.Capacity(VarRevB, true))
+	}
+
+	c1, c2 := net.Pipe()
+	go fd.serve(c2)
+	dev := &Device{
+		remote: &daemonClient{serial: "FAKE", conn: c1, enc: gob.NewEncoder(c1), dec: gob.NewDecoder(c1)},
+		desc:   DeviceDesc{Serial: "FAKE"},
+	}
+	t.Cleanup(func() { dev.Close() })
+	return dev, fd
+}
+
+func (fd *fakeDevice) serve(conn net.Conn) {
+	defer conn.Close()
+	enc, dec := gob.NewEncoder(conn), gob.NewDecoder(conn)
+	for {
+		var req daemonRequest
+		if err := dec.Decode(&req); err != nil {
+			return
+		}
+		rep := daemonReply{Out: make([]byte, req.OutLen)}
+		if err := fd.exec(&req, rep.Out); err != nil {
+			rep.Err = err.Error()
+		}
+		if err := enc.Encode(&rep); err != nil {
+			return
+		}
+	}
+}
+
+func (fd *fakeDevice) exec(req *daemonRequest, out []byte) error {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+
+	switch req.Cmd {
+	case CmdVersionRequest:
+		binary.BigEndian.PutUint16(out[0:2], uint16(VarRevB))
+		binary.BigEndian.PutUint16(out[2:4], uint16(VersionExtended))
+		copy(out[4:8], "UDEV")
+		return nil
+	case CmdDumpToPc, CmdLoadFromPc:
+	default:
+		return ErrUnsupported
+	}
+
+	offset, bank, size := req.Args[0], Bank(req.Args[1]>>24), int(req.Args[1]&0xFFFFFF)
+	if fd.fail != nil && fd.fail(req.Cmd, bank, offset) {
+		return ErrProtocol
+	}
+	mem := fd.mem[bank][offset : int(offset)+size]
+	if req.Cmd == CmdDumpToPc {
+		fd.downloads++
+		copy(out, mem)
+	} else {
+		fd.uploads++
+		copy(mem, req.In)
+	}
+	return nil
+}
+
+// checkLRU verifies that the LRU list and the cache contain the same blocks
+func checkLRU(t *testing.T, f *BankFile) {
+	t.Helper()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	seen := make(map[int64]bool)
+	for _, idx := range f.lru {
+		if seen[idx] {
+			t.Errorf("block %d is in the LRU list more than once", idx)
+		}
+		seen[idx] = true
+		if _, found := f.cache[idx]; !found {
+			t.Errorf("block %d is in the LRU list, but not in the cache", idx)
+		}
+	}
+	if len(f.cache) != len(f.lru) {
+		t.Errorf("%d cached blocks, but %d in the LRU list", len(f.cache), len(f.lru))
+	}
+	if len(f.cache) > bankCacheBlocks {
+		t.Errorf("%d cached blocks, more than the maximum (%d)", len(f.cache), bankCacheBlocks)
+	}
+}
+
+func TestBankFileCache(t *testing.T) {
+	dev, fd := newFakeDevice(t)
+	for i := range fd.mem[BankCARTROM][:4096] {
+		fd.mem[BankCARTROM][i] = byte(i * 7)
+	}
+	f, err := dev.OpenBank(context.Background(), BankCARTROM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 1000)
+	if _, err := f.ReadAt(buf, 100); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, fd.mem[BankCARTROM][100:1100]) {
+		t.Errorf("invalid data read")
+	}
+	if _, err := f.ReadAt(buf, 200); err != nil {
+		t.Fatal(err)
+	}
+	if fd.downloads != 1 {
+		t.Errorf("cached blocks downloaded again (%d downloads)", fd.downloads)
+	}
+
+	// The N64 modifies the memory: the cache is stale until invalidated
+	fd.mem[BankCARTROM][300] ^= 0xFF
+	f.InvalidateCache()
+	if _, err := f.ReadAt(buf, 200); err != nil {
+		t.Fatal(err)
+	}
+	if buf[100] != fd.mem[BankCARTROM][300] {
+		t.Errorf("stale data after InvalidateCache")
+	}
+	checkLRU(t, f)
+}
+
+func TestBankFileWrite(t *testing.T) {
+	dev, fd := newFakeDevice(t)
+	f, err := dev.OpenBank(context.Background(), BankSRAM256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		off  int64
+		size int
+	}{
+		{"aligned", 512, 1024},
+		{"unaligned start", 1030, 100},
+		{"unaligned end", 2048, 700},
+		{"across blocks", 3000, 3000},
+		{"single byte", 511, 1},
+		{"end of bank", 32*1024 - 10, 10},
+	}
+	for i, tt := range tests {
+		expected := append([]byte(nil), fd.mem[BankSRAM256]...)
+		data := bytes.Repeat([]byte{byte(i + 1)}, tt.size)
+		copy(expected[tt.off:], data)
+
+		if n, err := f.WriteAt(data, tt.off); err != nil || n != len(data) {
+			t.Fatalf("%s: WriteAt: %d, %v", tt.name, n, err)
+		}
+		if !bytes.Equal(fd.mem[BankSRAM256], expected) {
+			t.Errorf("%s: device memory differs after write", tt.name)
+		}
+
+		// The written blocks are cached, and coherent with the device
+		downloads := fd.downloads
+		buf := make([]byte, tt.size)
+		if _, err := f.ReadAt(buf, tt.off); err != nil {
+			t.Fatalf("%s: ReadAt: %v", tt.name, err)
+		}
+		if !bytes.Equal(buf, data) {
+			t.Errorf("%s: cached data differs after write", tt.name)
+		}
+		if fd.downloads != downloads {
+			t.Errorf("%s: written blocks were downloaded again", tt.name)
+		}
+		checkLRU(t, f)
+	}
+
+	all := make([]byte, f.Size())
+	if _, err := f.ReadAt(all, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(all, fd.mem[BankSRAM256]) {
+		t.Errorf("cached data differs from the device memory")
+	}
+
+	if _, err := f.WriteAt([]byte{1, 2}, f.Size()-1); err == nil {
+		t.Errorf("write past the end of the bank succeeded")
+	}
+}
+
+func TestBankFileWriteErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		fail func(cmd Cmd, bank Bank, offset uint32) bool
+	}{
+		{"upload fails", func(cmd Cmd, bank Bank, offset uint32) bool {
+			return cmd == CmdLoadFromPc
+		}},
+		{"read-modify-write fails", func(cmd Cmd, bank Bank, offset uint32) bool {
+			return cmd == CmdDumpToPc && offset == 1024
+		}},
+	}
+	for _, tt := range tests {
+		dev, fd := newFakeDevice(t)
+		f, err := dev.OpenBank(context.Background(), BankSRAM256)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Cache the first blocks, then fail a write to them
+		buf := make([]byte, 1024)
+		if _, err := f.ReadAt(buf, 0); err != nil {
+			t.Fatal(err)
+		}
+		fd.fail = tt.fail
+		if _, err := f.WriteAt(make([]byte, 1000), 100); !errors.Is(err, ErrProtocol) {
+			t.Fatalf("%s: unexpected error %v", tt.name, err)
+		}
+		fd.fail = nil
+		checkLRU(t, f)
+
+		// The blocks must be fetched again from the device
+		fd.mem[BankSRAM256][200] = 0x55
+		if _, err := f.ReadAt(buf, 0); err != nil {
+			t.Fatal(err)
+		}
+		if buf[200] != 0x55 {
+			t.Errorf("%s: stale data read after a failed write", tt.name)
+		}
+		checkLRU(t, f)
+	}
+}
+
+func TestBankFileLRU(t *testing.T) {
+	dev, fd := newFakeDevice(t)
+	f, err := dev.OpenBank(context.Background(), BankCARTROM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Read more blocks than the cache can hold, one at a time, then write
+	// some of them: the cache must never exceed its maximum size.
+	buf := make([]byte, 16)
+	for i := int64(0); i < bankCacheBlocks+10; i++ {
+		if _, err := f.ReadAt(buf, i*bankBlockSize); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkLRU(t, f)
+	for i := int64(0); i < 20; i++ {
+		if _, err := f.WriteAt(buf, i*bankBlockSize+8); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkLRU(t, f)
+
+	// The most recently read block is still cached, the first one was evicted
+	downloads := fd.downloads
+	f.ReadAt(buf, (bankCacheBlocks+9)*bankBlockSize)
+	if fd.downloads != downloads {
+		t.Errorf("recent block was evicted")
+	}
+	f.ReadAt(buf, 25*bankBlockSize)
+	if fd.downloads != downloads+1 {
+		t.Errorf("old block was not evicted")
+	}
+}
+
+func TestBankFileSeek(t *testing.T) {
+	dev, fd := newFakeDevice(t)
+	f, err := dev.OpenBank(context.Background(), BankEEPROM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.Seek(-4, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte{1, 2, 3, 4}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fd.mem[BankEEPROM][2044:], []byte{1, 2, 3, 4}) {
+		t.Errorf("invalid write at the end of the bank")
+	}
+	if n, err := f.Read(make([]byte, 4)); n != 0 || err != io.EOF {
+		t.Errorf("read at the end of the bank: %d, %v", n, err)
+	}
+
+	if pos, err := f.Seek(-6, io.SeekCurrent); err != nil || pos != 2042 {
+		t.Fatalf("Seek: %d, %v", pos, err)
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, []byte{0, 0, 1, 2, 3, 4}) {
+		t.Errorf("invalid data read: %x", data)
+	}
+	if _, err := f.Seek(-1, io.SeekStart); err == nil {
+		t.Errorf("seek to a negative position succeeded")
+	}
+}
+
+func TestBankFileConcurrentRead(t *testing.T) {
+	dev, fd := newFakeDevice(t)
+	for i := range fd.mem[BankSRAM768] {
+		fd.mem[BankSRAM768][i] = byte(i)
+	}
+	f, err := dev.OpenBank(context.Background(), BankSRAM768)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Concurrent readers share the position: together, they read the whole bank once
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	total := 0
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, 1000)
+			for {
+				n, err := f.Read(buf)
+				mu.Lock()
+				total += n
+				mu.Unlock()
+				if err != nil {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if total != int(f.Size()) {
+		t.Errorf("read %d bytes, expected %d", total, f.Size())
+	}
+	checkLRU(t, f)
+}
+
+func TestBankFileContext(t *testing.T) {
+	dev, fd := newFakeDevice(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	f, err := dev.OpenBank(ctx, BankCARTROM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Cached blocks are copies, not views of the transfer buffer
+	buf := make([]byte, 64*bankBlockSize)
+	if _, err := f.ReadAt(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	for idx, blk := range f.cache {
+		if cap(blk) != bankBlockSize {
+			t.Fatalf("block %d shares a buffer of %d bytes", idx, cap(blk))
+		}
+	}
+
+	// Once the context is canceled, accesses to the device fail
+	cancel()
+	downloads, uploads := fd.downloads, fd.uploads
+	if _, err := f.ReadAt(buf, 128*bankBlockSize); !errors.Is(err, context.Canceled) {
+		t.Errorf("ReadAt with canceled context: %v", err)
+	}
+	if _, err := f.WriteAt(buf, 128*bankBlockSize); !errors.Is(err, context.Canceled) {
+		t.Errorf("WriteAt with canceled context: %v", err)
+	}
+	if fd.downloads != downloads || fd.uploads != uploads {
+		t.Errorf("transfers executed with canceled context")
+	}
+	checkLRU(t, f)
+}
@@ -0,0 +1,130 @@
+package drive64
+
+import (
+	"context"
+	"fmt"
+)
+
+// Feature is an optional feature of 64drive, that depends on the hardware
+// variant and/or on the firmware version.
+type Feature int
+
+const (
+	// FeatureCIC is the CIC emulation (CmdSetCicType)
+	FeatureCIC Feature = iota
+	// FeatureExtended is the extended mode, to access ROMs larger than 64 MiB (CmdSetExtended)
+	FeatureExtended
+	// FeatureDebugFifo is the USB debug FIFO (CmdFifoRead)
+	FeatureDebugFifo
+)
+
+// FeatureInfo describes the requirements of a Feature
+type FeatureInfo struct {
+	Feature    Feature
+	Key        string  // Short name, used in machine-readable output (eg: "extended")
+	Name       string  // Description for humans
+	MinVariant Variant // Minimum hardware variant (0: any)
+	MinVersion Version // Minimum firmware version (0: any)
+}
+
+// FeatureInfos contains the requirements of all the optional features. New
+// firmware features should be added here, so that all commands and the
+// capabilities shown to the user are updated at once.
+var FeatureInfos = []FeatureInfo{
+	{FeatureCIC, "cic", "CIC emulation", VarRevB, 0},
+	{FeatureExtended, "extended", "extended mode (ROMs larger than 64 MiB)", VarRevB, VersionExtended},
+	{FeatureDebugFifo, "debug_fifo", "USB debug FIFO (g64drive debug)", 0, VersionDebugFifo},
+}
+
+// Info returns the description of the feature
+func (f Feature) Info() FeatureInfo {
+	for _, fi := range FeatureInfos {
+		if fi.Feature == f {
+			return fi
+		}
+	}
+	return FeatureInfo{Feature: f, Name: fmt.Sprintf("feature %d", int(f))}
+}
+
+// Capabilities describes what a 64drive can do, given its hardware variant
+// and firmware version (as returned by CmdVersionRequest).
+type Capabilities struct {
+	Variant  Variant
+	Firmware Version
+}
+
+// Supports returns true if the feature is available
+func (c Capabilities) Supports(f Feature) bool {
+	return c.Requirement(f) == ""
+}
+
+// Check returns nil if the feature is available, otherwise an error wrapping
+// ErrUnsupported that explains what is required.
+func (c Capabilities) Check(f Feature) error {
+	if req := c.Requirement(f); req != "" {
+		return fmt.Errorf("%w: %v requires %v", ErrUnsupported, f.Info().Name, req)
+	}
+	return nil
+}
+
+// Requirement describes what is missing to use the feature (eg: "64drive
+// firmware >= 2.06 (installed: 2.05)"), or returns an empty string if the
+// feature is available.
+func (c Capabilities) Requirement(f Feature) string {
+	fi := f.Info()
+	if c.Variant < fi.MinVariant {
+		return fmt.Sprintf("64drive %v", fi.MinVariant)
+	}
+	if c.Firmware < fi.MinVersion {
+		return fmt.Sprintf("64drive firmware >= %v (installed: %v)", fi.MinVersion, c.Firmware)
+	}
+	return ""
+}
+
+// MaxROMSize returns the size of the largest ROM that can be loaded
+// (using extended mode, if available).
+func (c Capabilities) MaxROMSize() int64 {
+	return BankCARTROM.Info().Capacity(c.Variant, c.Supports(FeatureExtended))
+}
+
+// SaveTypes returns the save types that can be emulated. All of them are
+// available on every known variant and firmware; FlashRAM1Mbit_PokStad2 is
+// only useful on HW1, but it is accepted by HW2 as well.
+func (c Capabilities) SaveTypes() []SaveType {
+	var types []SaveType
+	for _, sn := range SaveTypeNames {
+		types = append(types, sn.SaveType)
+	}
+	return types
+}
+
+// CheckSaveType returns nil if the save type can be emulated, otherwise an
+// error wrapping ErrUnsupported.
+func (c Capabilities) CheckSaveType(st SaveType) error {
+	for _, t := range c.SaveTypes() {
+		if t == st {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: save type %v", ErrUnsupported, st)
+}
+
+// Capabilities returns the capabilities of the device. Like CmdVersionRequest
+// (that it uses), it only requires a USB communication the first time.
+func (d *Device) Capabilities(ctx context.Context) (Capabilities, error) {
+	hwver, fwver, _, err := d.CmdVersionRequest(ctx)
+	if err != nil {
+		return Capabilities{}, err
+	}
+	return Capabilities{hwver, fwver}, nil
+}
+
+// require returns an error wrapping ErrUnsupported if the feature is not
+// available on the device.
+func (d *Device) require(ctx context.Context, f Feature) error {
+	caps, err := d.Capabilities(ctx)
+	if err != nil {
+		return err
+	}
+	return caps.Check(f)
+}
@@ -3,6 +3,8 @@ package drive64
 import (
 	"errors"
 	"fmt"
+	"strconv"
+	"strings"
 )
 
 //go:generate stringer -type=Cmd,Bank,CIC,SaveType,UpgradeStatus -output=const_string.go
@@ -29,6 +31,37 @@ const (
 	CmdUpgradeReport Cmd = 0x85
 )
 
+// Cmds lists all the commands known by this package
+var Cmds = []Cmd{
+	CmdLoadFromPc, CmdDumpToPc, CmdSetCicType, CmdSetSaveType, CmdSetExtended,
+	CmdVersionRequest, CmdUpgradeStart, CmdUpgradeReport,
+}
+
+// Known returns true if the command is one of the commands known by this package
+func (c Cmd) Known() bool {
+	for _, k := range Cmds {
+		if k == c {
+			return true
+		}
+	}
+	return false
+}
+
+// NewCmdFromString parses a command, specified either by number (eg: "0x80")
+// or by name (eg: "CmdVersionRequest" or "versionrequest", case-insensitive).
+func NewCmdFromString(s string) (Cmd, error) {
+	if v, err := strconv.ParseUint(s, 0, 8); err == nil {
+		return Cmd(v), nil
+	}
+	for _, c := range Cmds {
+		name := c.String()
+		if strings.EqualFold(s, name) || strings.EqualFold(s, strings.TrimPrefix(name, "Cmd")) {
+			return c, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid command: %q", s)
+}
+
 // Variant represent the hardware variant (revision)
 type Variant uint16
 
@@ -57,6 +90,28 @@ func (v Version) String() string {
 	return fmt.Sprintf("%d.%02d", v/100, v%100)
 }
 
+// Firmware versions that introduced features used by g64drive
+const (
+	// VersionDebugFifo is the first firmware with the USB debug FIFO (CmdFifoRead)
+	VersionDebugFifo Version = 205
+	// VersionExtended is the first firmware supporting extended mode (CmdSetExtended)
+	VersionExtended Version = 206
+)
+
+// NewVersionFromString parses a firmware version in the format "2.05"
+func NewVersionFromString(s string) (Version, error) {
+	idx := strings.IndexByte(s, '.')
+	if idx <= 0 || len(s)-idx != 3 {
+		return 0, fmt.Errorf("invalid version: %q", s)
+	}
+	major, err1 := strconv.ParseUint(s[:idx], 10, 16)
+	minor, err2 := strconv.ParseUint(s[idx+1:], 10, 8)
+	if err1 != nil || err2 != nil || major*100+minor > 0xFFFF {
+		return 0, fmt.Errorf("invalid version: %q", s)
+	}
+	return Version(major*100 + minor), nil
+}
+
 // Bank represents a Nintendo 64 memory bank
 type Bank uint8
 
@@ -108,34 +163,35 @@ const (
 // returns the corresponding CIC value, or an error if the string doesn't match
 // any known CIC variant.
 func NewCICFromString(name string) (CIC, error) {
-	switch name {
-	case "6101":
-		return CIC6101, nil
-	case "6102":
-		return CIC6102, nil
-	case "7101":
-		return CIC7101, nil
-	case "7102":
-		return CIC7102, nil
-	case "6103", "7103", "X103", "x103":
-		return CICX103, nil
-	case "6105", "7105", "X105", "x105":
-		return CICX105, nil
-	case "6106", "7106", "X106", "x106":
-		return CICX106, nil
-	case "5101":
-		return CIC5101, nil
-	case "8303":
-		return CIC8303, nil
-	case "8401":
-		return CIC8401, nil
-	case "5167":
-		return CIC5167, nil
-	case "DDUE":
-		return CICDDUS, nil
-	default:
-		return 0, errors.New("invalid CIC variant")
+	for _, cn := range CICNames {
+		if cn.Name == name {
+			return cn.CIC, nil
+		}
 	}
+	return 0, errors.New("invalid CIC variant")
+}
+
+// CICName associates a name of a CIC variant (as accepted by NewCICFromString)
+// with its value. Some variants have more than one name.
+type CICName struct {
+	Name string
+	CIC  CIC
+}
+
+// CICNames contains all the names accepted by NewCICFromString
+var CICNames = []CICName{
+	{"6101", CIC6101},
+	{"6102", CIC6102},
+	{"7101", CIC7101},
+	{"7102", CIC7102},
+	{"6103", CICX103}, {"7103", CICX103}, {"X103", CICX103}, {"x103", CICX103},
+	{"6105", CICX105}, {"7105", CICX105}, {"X105", CICX105}, {"x105", CICX105},
+	{"6106", CICX106}, {"7106", CICX106}, {"X106", CICX106}, {"x106", CICX106},
+	{"5101", CIC5101},
+	{"8303", CIC8303},
+	{"8401", CIC8401},
+	{"5167", CIC5167},
+	{"DDUE", CICDDUS},
 }
 
 // NewCICFromHeader detects a CIC variant from a ROM header
@@ -181,24 +237,30 @@ func NewCICFromHeader(header []uint8) (CIC, error) {
 }
 
 func NewSaveTypeFromString(name string) (SaveType, error) {
-	switch name {
-	case "none":
-		return SaveNone, nil
-	case "eeprom4kbit":
-		return SaveEeprom4Kbit, nil
-	case "eeprom16kbit":
-		return SaveEeprom16Kbit, nil
-	case "sram256kbit":
-		return SaveSRAM256Kbit, nil
-	case "flash1mbit":
-		return SaveFlashRAM1Mbit, nil
-	case "sram768kbit":
-		return SaveSRAM768Kbit, nil
-	case "flash1mbit_pokstad2":
-		return SaveFlashRAM1Mbit_PokStad2, nil
-	default:
-		return 0, errors.New("invalid save type")
+	for _, sn := range SaveTypeNames {
+		if sn.Name == name {
+			return sn.SaveType, nil
+		}
 	}
+	return 0, errors.New("invalid save type")
+}
+
+// SaveTypeName associates the name of a save type (as accepted by
+// NewSaveTypeFromString) with its value.
+type SaveTypeName struct {
+	Name     string
+	SaveType SaveType
+}
+
+// SaveTypeNames contains all the names accepted by NewSaveTypeFromString
+var SaveTypeNames = []SaveTypeName{
+	{"none", SaveNone},
+	{"eeprom4kbit", SaveEeprom4Kbit},
+	{"eeprom16kbit", SaveEeprom16Kbit},
+	{"sram256kbit", SaveSRAM256Kbit},
+	{"flash1mbit", SaveFlashRAM1Mbit},
+	{"sram768kbit", SaveSRAM768Kbit},
+	{"flash1mbit_pokstad2", SaveFlashRAM1Mbit_PokStad2},
 }
 
 // UpgradeStatus represents the current status of the firmware upgrade
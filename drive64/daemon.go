@@ -0,0 +1,281 @@
+package drive64
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A 64drive can be owned by a local daemon (see Device.Serve), which multiplexes
+// commands coming from other processes. The daemon keeps the device lock, so
+// DeviceDesc.Open transparently connects to the daemon socket when it finds the
+// device locked.
+//
+// The protocol is a simple sequence of gob-encoded request/reply pairs over
+// a Unix socket. Requests are executed through the daemon's Device, so they are
+// serialized with any other activity on the device (eg: FIFO polling).
+
+type daemonOp uint8
+
+const (
+	daemonOpCmd daemonOp = iota
+	daemonOpFifoRead
+	daemonOpRecover
+)
+
+type daemonRequest struct {
+	Op       daemonOp
+	Cmd      Cmd
+	Args     []uint32
+	In       []byte
+	OutLen   int
+	Deadline time.Time
+}
+
+type daemonReply struct {
+	Out []byte
+	Typ uint8
+	Err string
+}
+
+// Maximum time a FIFO read request can block in the daemon. Clients
+// poll again if no data was received; this makes sure that the daemon
+// doesn't keep polling the FIFO on behalf of clients that went away,
+// and that clients can interleave other commands.
+const daemonFifoPoll = 250 * time.Millisecond
+
+// Errors that are transferred by identity through the daemon socket, so that
+// clients can compare them as usual. Errors that wrap one of them (with a
+// message starting with it, eg: "%w: details") are wrapped again on the client side.
+var daemonErrors = []error{
+	ErrFrozen, ErrUnsupported, ErrInvalidFifoHead, ErrPartialWrite, ErrShortWriter,
+	ErrProtocol, ErrIntegrity, ErrAborted,
+	context.Canceled, context.DeadlineExceeded,
+}
+
+func daemonSocketPath(serial string) (string, error) {
+	dir, err := runtimeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, serial+".sock"), nil
+}
+
+func daemonError(msg string) error {
+	if msg == "" {
+		return nil
+	}
+	for _, err := range daemonErrors {
+		if err.Error() == msg {
+			return err
+		}
+	}
+	for _, err := range daemonErrors {
+		if details := strings.TrimPrefix(msg, err.Error()); details != msg {
+			return fmt.Errorf("%w%s", err, details)
+		}
+	}
+	return errors.New(msg)
+}
+
+// Serve makes the device available to other processes through a local socket,
+// until ctx is canceled. While the device is being served, DeviceDesc.Open
+// called by other processes returns a Device that goes through this daemon.
+func (d *Device) Serve(ctx context.Context) error {
+	if d.remote != nil {
+		return errors.New("64drive is already served by another daemon")
+	}
+
+	// We own the device lock, so any existing socket is stale.
+	path, err := daemonSocketPath(d.desc.Serial)
+	if err != nil {
+		return err
+	}
+	os.Remove(path)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go d.serveConn(ctx, conn)
+	}
+}
+
+func (d *Device) serveConn(ctx context.Context, conn net.Conn) {
+	done := make(chan struct{})
+	defer close(done)
+	defer conn.Close()
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	enc := gob.NewEncoder(conn)
+	dec := gob.NewDecoder(conn)
+	for {
+		var req daemonRequest
+		if err := dec.Decode(&req); err != nil {
+			return
+		}
+
+		rctx, cancel := ctx, context.CancelFunc(func() {})
+		if !req.Deadline.IsZero() {
+			rctx, cancel = context.WithDeadline(ctx, req.Deadline)
+		}
+
+		var rep daemonReply
+		var err error
+		switch req.Op {
+		case daemonOpCmd:
+			rep.Out = make([]byte, req.OutLen)
+			err = d.SendCmd(rctx, req.Cmd, req.Args, req.In, rep.Out)
+		case daemonOpFifoRead:
+			rep.Typ, rep.Out, err = d.CmdFifoRead(rctx)
+		case daemonOpRecover:
+			err = d.Recover(rctx)
+		default:
+			err = errors.New("invalid daemon request")
+		}
+		cancel()
+
+		if err != nil {
+			rep.Err = err.Error()
+		}
+		if err := enc.Encode(&rep); err != nil {
+			return
+		}
+	}
+}
+
+// daemonClient is the connection to a daemon that owns a 64drive.
+// It is not safe for concurrent use: Device serializes calls.
+type daemonClient struct {
+	serial string
+	conn   net.Conn
+	enc    *gob.Encoder
+	dec    *gob.Decoder
+}
+
+func dialDaemon(serial string) (*daemonClient, error) {
+	c := &daemonClient{serial: serial}
+	if err := c.dial(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *daemonClient) dial() error {
+	path, err := daemonSocketPath(c.serial)
+	if err != nil {
+		return err
+	}
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return err
+	}
+	c.conn = conn
+	c.enc = gob.NewEncoder(conn)
+	c.dec = gob.NewDecoder(conn)
+	return nil
+}
+
+func (c *daemonClient) close() error {
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.Close()
+}
+
+func (c *daemonClient) call(ctx context.Context, req *daemonRequest) (*daemonReply, error) {
+	if c.conn == nil {
+		// A previous call was aborted halfway, so the stream is out of sync.
+		if err := c.dial(); err != nil {
+			return nil, err
+		}
+	}
+	if dl, ok := ctx.Deadline(); ok && (req.Deadline.IsZero() || dl.Before(req.Deadline)) {
+		req.Deadline = dl
+	}
+
+	// Abort any pending I/O on the socket if ctx is canceled
+	done, exited := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			c.conn.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+
+	var rep daemonReply
+	err := c.enc.Encode(req)
+	if err == nil {
+		err = c.dec.Decode(&rep)
+	}
+	close(done)
+	<-exited
+	if err == nil && ctx.Err() != nil {
+		// ctx was canceled right after the reply was received: the connection
+		// is still in sync, but its deadline might have been set.
+		err = c.conn.SetDeadline(time.Time{})
+	}
+	if err != nil {
+		c.conn.Close()
+		c.conn = nil
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return &rep, daemonError(rep.Err)
+}
+
+func (c *daemonClient) sendCmd(ctx context.Context, cmd Cmd, args []uint32, in []byte, out []byte) error {
+	rep, err := c.call(ctx, &daemonRequest{Op: daemonOpCmd, Cmd: cmd, Args: args, In: in, OutLen: len(out)})
+	if err != nil {
+		return err
+	}
+	copy(out, rep.Out)
+	return nil
+}
+
+// fifoRead polls the daemon for a FIFO packet. Like Device.fifoRead, it
+// returns ErrFrozen if no data was received.
+func (c *daemonClient) fifoRead(ctx context.Context) (uint8, []byte, error) {
+	rep, err := c.call(ctx, &daemonRequest{Op: daemonOpFifoRead, Deadline: time.Now().Add(daemonFifoPoll)})
+	if err == context.DeadlineExceeded && ctx.Err() == nil {
+		return 0, nil, ErrFrozen
+	} else if err != nil {
+		return 0, nil, err
+	}
+	return rep.Typ, rep.Out, nil
+}
+
+func (c *daemonClient) recover(ctx context.Context) error {
+	_, err := c.call(ctx, &daemonRequest{Op: daemonOpRecover})
+	return err
+}
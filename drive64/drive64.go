@@ -7,20 +7,32 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"os"
 	"runtime"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/ziutek/ftdi"
 )
 
+// Errors returned by this package. Errors with more details wrap one of them
+// (with fmt.Errorf and %w), so they should be checked with errors.Is.
 var (
 	ErrNoDevices       = errors.New("no 64drive devices found")
 	ErrMultipleDevices = errors.New("multiple 64drive devices found")
-	ErrFrozen          = errors.New("64drive seems frozen, please reset it")
-	ErrUnsupported     = errors.New("operation is not supported on this 64drive revision")
-	ErrInvalidFifoHead = errors.New("invalid FIFO header")
+	ErrFrozen          = errors.New("64drive seems frozen, try \"g64drive reset-link\" or power-cycle it")
+	ErrUnsupported     = errors.New("operation not supported by this 64drive hardware or firmware")
 	ErrUnknownDevice   = errors.New("found compatible USB device which cannot be accessed")
+	ErrShortWriter     = errors.New("provided writer does not respect io.Writer interface")
+	ErrDeviceBusy      = errors.New("64drive is being used by another process")
+	ErrWrongDevice     = errors.New("firmware archive not meant for this device")
+	ErrProtocol        = errors.New("64drive protocol error")
+	ErrIntegrity       = errors.New("transfer integrity check failed")
+	ErrAborted         = errors.New("operation aborted by the user")
+
+	ErrInvalidFifoHead = fmt.Errorf("%w: invalid FIFO header", ErrProtocol)
+	ErrPartialWrite    = fmt.Errorf("%w: partial USB write", ErrProtocol)
 )
 
 func init() {
@@ -56,8 +68,20 @@ func (d *DeviceDesc) guessVariant() Variant {
 	}
 }
 
-// Open this 64drive device
+// Open this 64drive device. If the device is owned by a g64drive daemon (see
+// Device.Serve), the returned Device transparently sends commands through it.
+// If it is being used by another process, ErrDeviceBusy is returned.
 func (d *DeviceDesc) Open() (*Device, error) {
+	lock, err := lockDevice(d.Serial)
+	if err == errLocked {
+		if remote, err := dialDaemon(d.Serial); err == nil {
+			return &Device{remote: remote, desc: *d}, nil
+		}
+		return nil, ErrDeviceBusy
+	} else if err != nil {
+		return nil, err
+	}
+
 	usb, err := ftdi.Open(vid, d.ProductID, d.Description, d.Serial, 0, ftdi.ChannelAny)
 	if d.guessVariant() != VarRevA {
 		// HW2 version requires synchronous mode
@@ -71,39 +95,61 @@ func (d *DeviceDesc) Open() (*Device, error) {
 	if err == nil {
 		err = usb.PurgeBuffers()
 	}
-	return &Device{usb: drive64Device{usb}, desc: *d}, err
+	if err != nil {
+		lock.Close()
+	}
+	return &Device{usb: drive64Device{usb}, lock: lock, desc: *d}, err
+}
+
+// EnumerateFTDI returns all the FTDI devices with one of the product IDs used by
+// 64drive, including those that are not a 64drive. USB strings are empty if the
+// device cannot be accessed (eg: because of permissions or drivers).
+func EnumerateFTDI() ([]DeviceDesc, error) {
+	var devices []DeviceDesc
+	for _, pid := range pids {
+		devs, err := ftdi.FindAll(vid, pid)
+		if err != nil {
+			return nil, fmt.Errorf("cannot enumerate USB devices (%04x:%04x): %w", vid, pid, err)
+		}
+		for _, d := range devs {
+			devices = append(devices, DeviceDesc{
+				Manufacturer: d.Manufacturer,
+				Description:  d.Description,
+				Serial:       d.Serial,
+				VendorID:     vid,
+				ProductID:    pid,
+			})
+		}
+	}
+	return devices, nil
+}
+
+// Is64drive returns true if the USB strings identify the device as a 64drive
+func (d *DeviceDesc) Is64drive() bool {
+	return d.Manufacturer == "Retroactive" && strings.HasPrefix(d.Description, "64drive")
 }
 
 // Enumerate returns a list of all 64drive devices found attached to this system.
 // It also returns a boolean flag indicating whether unknown compatible devices
 // were found; on Windows, this might indicate a device which has no libusb-compatible
 // drivers.
-func Enumerate() ([]DeviceDesc, bool) {
+func Enumerate() ([]DeviceDesc, bool, error) {
 	var devices []DeviceDesc
 	var unknown bool
 
-	for _, pid := range pids {
-		devs, err := ftdi.FindAll(vid, pid)
-		if err != nil {
-			panic(err)
+	devs, err := EnumerateFTDI()
+	if err != nil {
+		return nil, false, err
+	}
+	for _, d := range devs {
+		if d.Manufacturer == "" && d.Description == "" && d.Serial == "" {
+			unknown = true
 		}
-		for _, d := range devs {
-			if d.Manufacturer == "" && d.Description == "" && d.Serial == "" {
-				unknown = true
-			}
-			if d.Manufacturer == "Retroactive" && strings.HasPrefix(d.Description, "64drive") {
-				devices = append(devices, DeviceDesc{
-					Manufacturer: d.Manufacturer,
-					Description:  d.Description,
-					Serial:       d.Serial,
-					VendorID:     vid,
-					ProductID:    pid,
-				})
-			}
+		if d.Is64drive() {
+			devices = append(devices, d)
 		}
 	}
-
-	return devices, unknown
+	return devices, unknown, nil
 }
 
 type drive64Device struct {
@@ -133,17 +179,76 @@ func (d *drive64Device) Read(buf []byte) (int, error) {
 	return 0, ErrFrozen
 }
 
+// readFull reads exactly len(buf) bytes, like io.ReadFull. If ctx has a deadline,
+// empty reads are retried until the deadline expires; otherwise, it gives up
+// with ErrFrozen like Read does.
+func (d *drive64Device) readFull(ctx context.Context, buf []byte) error {
+	_, hasDeadline := ctx.Deadline()
+	for len(buf) > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n, err := d.Read(buf)
+		buf = buf[n:]
+		if err == ErrFrozen && hasDeadline {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// drain reads and discards any pending data from the device, until
+// no more data is available.
+func (d *drive64Device) drain(ctx context.Context) (int, error) {
+	var buf [4096]byte
+	total := 0
+	for ctx.Err() == nil {
+		n, err := d.Read(buf[:])
+		total += n
+		if err == ErrFrozen {
+			return total, nil
+		} else if err != nil {
+			return total, err
+		}
+	}
+	return total, ctx.Err()
+}
+
+// Device is an open 64drive device. It is safe for concurrent use: command
+// transactions are serialized, so that for instance FIFO polling and bank
+// transfers can run from separate goroutines.
 type Device struct {
-	usb  drive64Device
-	desc DeviceDesc
-	vers [8]byte
+	mu      sync.Mutex
+	usb     drive64Device
+	remote  *daemonClient // set if the device is owned by a daemon
+	dry     *dryRun       // set in dry-run mode (see DryRun)
+	lock    *os.File
+	desc    DeviceDesc
+	vers    [8]byte
+	profile LinkProfile
+	refs    int    // additional references taken with Retain
+	fifo    []byte // FIFO packet partially received (see fifoRead)
+}
+
+// LinkProfile contains tuning parameters for the USB link of a 64drive device.
+// The best values depend on the host, the USB controller and any hub in between,
+// so they are usually measured with a benchmark.
+type LinkProfile struct {
+	ChunkSize    int           // Size of each bulk transfer command (0 = automatic, based on transfer size)
+	LatencyTimer time.Duration // FTDI latency timer (0 = driver default)
 }
 
 // NewDeviceSingle opens a connected 64drive device, that must be the only one
 // connected to this PC. If multiple devices are found, it returns ErrMultipleDevices.
 // If no devices are found, it returns ErrNoDevices.
 func NewDeviceSingle() (*Device, error) {
-	devs, unk := Enumerate()
+	devs, unk, err := Enumerate()
+	if err != nil {
+		return nil, err
+	}
 	if len(devs) == 0 {
 		if unk {
 			return nil, ErrUnknownDevice
@@ -159,7 +264,10 @@ func NewDeviceSingle() (*Device, error) {
 // NewDeviceBySerial opens a specified 64drive, identified by its serial number.
 // If no device is found, ErrNoDevices is returned.
 func NewDeviceBySerial(serial string) (*Device, error) {
-	devs, unk := Enumerate()
+	devs, unk, err := Enumerate()
+	if err != nil {
+		return nil, err
+	}
 	for _, d := range devs {
 		if d.Serial == serial {
 			return d.Open()
@@ -171,19 +279,185 @@ func NewDeviceBySerial(serial string) (*Device, error) {
 	return nil, ErrNoDevices
 }
 
+// Interval between two enumerations while waiting for a device to be attached.
+// libusb hotplug events are not used because release binaries are built
+// without udev support, so polling is the only portable option.
+const waitPollInterval = 250 * time.Millisecond
+
+// waitDevice polls Enumerate until match selects a device, or ctx is canceled.
+// match is called with the list of attached devices and returns the device
+// to open (if any), or an error that aborts the wait.
+func waitDevice(ctx context.Context, match func(devs []DeviceDesc) (*DeviceDesc, error)) (*Device, error) {
+	for {
+		devs, _, err := Enumerate()
+		if err != nil {
+			return nil, err
+		}
+		d, err := match(devs)
+		if err != nil {
+			return nil, err
+		}
+		if d != nil {
+			dev, err := d.Open()
+			if err != nil {
+				return nil, err
+			}
+			return dev, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(waitPollInterval):
+		}
+	}
+}
+
+// WaitDeviceSingle is like NewDeviceSingle, but if no device is attached, it blocks
+// until one is plugged in or ctx is canceled. If multiple devices are found,
+// it returns ErrMultipleDevices.
+func WaitDeviceSingle(ctx context.Context) (*Device, error) {
+	return waitDevice(ctx, func(devs []DeviceDesc) (*DeviceDesc, error) {
+		switch len(devs) {
+		case 0:
+			return nil, nil
+		case 1:
+			return &devs[0], nil
+		default:
+			return nil, ErrMultipleDevices
+		}
+	})
+}
+
+// WaitDeviceBySerial is like NewDeviceBySerial, but if the device is not attached,
+// it blocks until it is plugged in or ctx is canceled.
+func WaitDeviceBySerial(ctx context.Context, serial string) (*Device, error) {
+	return waitDevice(ctx, func(devs []DeviceDesc) (*DeviceDesc, error) {
+		for i := range devs {
+			if devs[i].Serial == serial {
+				return &devs[i], nil
+			}
+		}
+		return nil, nil
+	})
+}
+
+// IsAttached returns true if the device is still attached to the system.
+// It can be used to tell a disconnection apart from other USB errors.
+// If the devices cannot be enumerated, it assumes that the device is attached.
+func (d *DeviceDesc) IsAttached() bool {
+	devs, _, err := Enumerate()
+	if err != nil {
+		return true
+	}
+	for _, dd := range devs {
+		if dd.Serial == d.Serial {
+			return true
+		}
+	}
+	return false
+}
+
 // Description returns a DeviceDesc that describes the current device
 func (d *Device) Description() DeviceDesc {
 	return d.desc
 }
 
+// Retain takes an additional reference to the device, so that it can be shared:
+// the device is actually closed only when Close has been called once for each
+// reference (including the one returned when the device was opened).
+func (d *Device) Retain() *Device {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.refs++
+	return d
+}
+
 // Close closes an open 64drive device
 func (d *Device) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.refs > 0 {
+		d.refs--
+		return nil
+	}
+	if d.dry != nil {
+		return d.dry.parent.Close()
+	}
+	if d.remote != nil {
+		return d.remote.close()
+	}
+	defer d.lock.Close()
 	return d.usb.Close()
 }
 
+// Recover tries to bring a stuck 64drive back to a working state, without
+// power-cycling it. It purges the FTDI buffers, drains any stale completion or
+// FIFO data still queued on the USB link, resets the synchronous FIFO mode (HW2),
+// and finally checks that the device answers a CmdVersionRequest.
+func (d *Device) Recover(ctx context.Context) error {
+	if err := d.resetLink(ctx); err != nil {
+		return err
+	}
+	_, _, _, err := d.CmdVersionRequest(ctx)
+	return err
+}
+
+func (d *Device) resetLink(ctx context.Context) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// Forget the cached version, to force a real roundtrip
+	d.vers = [8]byte{}
+
+	if d.dry != nil {
+		return nil
+	}
+	if d.remote != nil {
+		return d.remote.recover(ctx)
+	}
+	// Any FIFO packet in progress is lost with the pending data
+	d.fifo = nil
+	if err := d.usb.PurgeBuffers(); err != nil {
+		return err
+	}
+	if _, err := d.usb.drain(ctx); err != nil {
+		return err
+	}
+	if d.desc.guessVariant() != VarRevA {
+		if err := d.usb.SetBitmode(0xFF, ftdi.ModeReset); err != nil {
+			return err
+		}
+		if err := d.usb.SetBitmode(0xFF, ftdi.ModeSyncFF); err != nil {
+			return err
+		}
+	}
+	return d.usb.PurgeBuffers()
+}
+
 // SendCmd sends a raw command to 64drive. This is a low-level method, most
 // clients should use one of the Cmd* methods.
-func (d *Device) SendCmd(cmd Cmd, args []uint32, in []byte, out []byte) error {
+// If ctx has a deadline, SendCmd waits for the 64drive to answer until the
+// deadline expires, otherwise after a short while; either way, it then returns
+// an error wrapping ErrFrozen.
+func (d *Device) SendCmd(ctx context.Context, cmd Cmd, args []uint32, in []byte, out []byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.sendCmd(ctx, cmd, args, in, out)
+}
+
+// sendCmd is like SendCmd, but must be called with d.mu held.
+func (d *Device) sendCmd(ctx context.Context, cmd Cmd, args []uint32, in []byte, out []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if d.dry != nil {
+		return d.dry.sendCmd(ctx, cmd, args, in, out)
+	}
+	if d.remote != nil {
+		return d.remote.sendCmd(ctx, cmd, args, in, out)
+	}
+
 	var buf bytes.Buffer
 	var abuf [4]byte
 
@@ -199,19 +473,27 @@ func (d *Device) SendCmd(cmd Cmd, args []uint32, in []byte, out []byte) error {
 		return err
 	} else if n != buf.Len() {
 		// Don't trust go-ftdi to implement Go io.Writer interface correctly
-		panic("partial USB write")
+		return ErrPartialWrite
 	}
 
+	// If the deadline expires while waiting for the answer, the device is frozen
+	readFull := func(buf []byte) error {
+		err := d.usb.readFull(ctx, buf)
+		if errors.Is(err, context.DeadlineExceeded) {
+			return fmt.Errorf("%w (no answer to %v)", ErrFrozen, cmd)
+		}
+		return err
+	}
 	if len(out) > 0 {
-		if _, err := io.ReadFull(&d.usb, out); err != nil {
+		if err := readFull(out); err != nil {
 			return err
 		}
 	}
-	if _, err := io.ReadFull(&d.usb, abuf[:]); err != nil {
+	if err := readFull(abuf[:]); err != nil {
 		return err
 	}
 	if abuf[0] != 0x43 || abuf[1] != 0x4D || abuf[2] != 0x50 || abuf[3] != byte(cmd) {
-		return fmt.Errorf("SendCmd: invalid completion packet (%x)", abuf)
+		return fmt.Errorf("%w: invalid completion packet for %v (%x)", ErrProtocol, cmd, abuf)
 	}
 	return nil
 }
@@ -221,11 +503,15 @@ func (d *Device) SendCmd(cmd Cmd, args []uint32, in []byte, out []byte) error {
 // for this device).
 // The result of this call is internally cached, so that it doesn't require a USB
 // communication after the first time it is invoked.
-func (d *Device) CmdVersionRequest() (hwver Variant, fwver Version, magic [4]byte, err error) {
+func (d *Device) CmdVersionRequest(ctx context.Context) (hwver Variant, fwver Version, magic [4]byte, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 	if binary.LittleEndian.Uint64(d.vers[:]) == 0 {
-		if err = d.SendCmd(CmdVersionRequest, nil, nil, d.vers[:]); err != nil {
+		var vers [8]byte
+		if err = d.sendCmd(ctx, CmdVersionRequest, nil, nil, vers[:]); err != nil {
 			return
 		}
+		d.vers = vers
 	}
 	hwver = Variant(binary.BigEndian.Uint16(d.vers[0:2]))
 	fwver = Version(binary.BigEndian.Uint16(d.vers[2:4]))
@@ -234,33 +520,81 @@ func (d *Device) CmdVersionRequest() (hwver Variant, fwver Version, magic [4]byt
 }
 
 // CmdSetCicType configures the 64drive CIC emulation to the specified CIC version.
-// CIC emulation is only available on 64drive HW2/RevB. The function will return
-// ErrUnsupported when executed on HW1/RevA device.
-func (d *Device) CmdSetCicType(cic CIC) error {
-	hwver, _, _, err := d.CmdVersionRequest()
-	if err != nil {
+// CIC emulation is only available on 64drive HW2/RevB (see FeatureCIC). The function
+// will return ErrUnsupported when executed on HW1/RevA device.
+func (d *Device) CmdSetCicType(ctx context.Context, cic CIC) error {
+	if err := d.require(ctx, FeatureCIC); err != nil {
 		return err
 	}
-	if hwver < VarRevB {
-		return ErrUnsupported
-	}
 	var args [1]uint32
 	args[0] = 0x80000000 | uint32(cic)
-	return d.SendCmd(CmdSetCicType, args[:], nil, nil)
+	return d.SendCmd(ctx, CmdSetCicType, args[:], nil, nil)
 }
 
-func (d *Device) CmdSetSaveType(st SaveType) error {
+// CmdSetSaveType configures the save memory emulation. It returns ErrUnsupported
+// if the save type is not supported by the device (see Capabilities.SaveTypes).
+func (d *Device) CmdSetSaveType(ctx context.Context, st SaveType) error {
+	if caps, err := d.Capabilities(ctx); err != nil {
+		return err
+	} else if err := caps.CheckSaveType(st); err != nil {
+		return err
+	}
 	var args [1]uint32
 	args[0] = uint32(st)
-	return d.SendCmd(CmdSetSaveType, args[:], nil, nil)
+	return d.SendCmd(ctx, CmdSetSaveType, args[:], nil, nil)
 }
 
-func (d *Device) CmdSetExtended(enable bool) error {
+// CmdSetExtended enables or disables the extended mode, which makes the whole
+// SDRAM available as CARTROM. It returns ErrUnsupported if the device doesn't
+// support it (see FeatureExtended).
+func (d *Device) CmdSetExtended(ctx context.Context, enable bool) error {
+	if err := d.require(ctx, FeatureExtended); err != nil {
+		return err
+	}
 	var args [1]uint32
 	if enable {
 		args[0] = 1
 	}
-	return d.SendCmd(CmdSetExtended, args[:], nil, nil)
+	return d.SendCmd(ctx, CmdSetExtended, args[:], nil, nil)
+}
+
+// SetLinkProfile configures the USB link tuning parameters used by this device.
+func (d *Device) SetLinkProfile(p LinkProfile) error {
+	if p.ChunkSize < 0 || p.ChunkSize%512 != 0 {
+		return errors.New("invalid chunk size (must be multiple of 512)")
+	}
+	if p.LatencyTimer < 0 || (p.LatencyTimer > 0 && p.LatencyTimer < time.Millisecond) || p.LatencyTimer > 255*time.Millisecond {
+		return errors.New("invalid latency timer (must be between 1ms and 255ms, or 0 for the driver default)")
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	// The latency timer only exists on the FTDI side; when going through
+	// a daemon, it is the daemon that configures it.
+	if d.remote == nil && d.dry == nil && p.LatencyTimer != 0 {
+		if err := d.usb.SetLatencyTimer(p.LatencyTimer); err != nil {
+			return err
+		}
+	}
+	d.profile = p
+	return nil
+}
+
+// LinkProfile returns the USB link tuning parameters currently in use.
+func (d *Device) LinkProfile() LinkProfile {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.profile
+}
+
+// chunkSize returns the size of each bulk command for a transfer of the specified size.
+func (d *Device) chunkSize(size int64) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.profile.ChunkSize != 0 {
+		return d.profile.ChunkSize
+	}
+	return idealChunkSize(size)
 }
 
 func idealChunkSize(size int64) int {
@@ -278,8 +612,12 @@ func (d *Device) CmdUpload(ctx context.Context, r io.Reader, n int64, bank Bank,
 	var cmdargs [2]uint32
 	cmdargs[0] = offset
 
-	chunkSize := idealChunkSize(n)
-	d.usb.SetWriteChunkSize(chunkSize + 12)
+	chunkSize := d.chunkSize(n)
+	if d.remote == nil && d.dry == nil {
+		d.mu.Lock()
+		d.usb.SetWriteChunkSize(chunkSize + 12)
+		d.mu.Unlock()
+	}
 
 	for n > 0 && ctx.Err() == nil {
 		sz := chunkSize
@@ -304,7 +642,7 @@ func (d *Device) CmdUpload(ctx context.Context, r io.Reader, n int64, bank Bank,
 		}
 
 		cmdargs[1] = uint32(bank)<<24 | uint32(read)
-		if err := d.SendCmd(CmdLoadFromPc, cmdargs[:], buf, nil); err != nil {
+		if err := d.SendCmd(ctx, CmdLoadFromPc, cmdargs[:], buf, nil); err != nil {
 			return err
 		}
 		cmdargs[0] += uint32(read)
@@ -318,8 +656,12 @@ func (d *Device) CmdDownload(ctx context.Context, w io.Writer, n int64, bank Ban
 	var cmdargs [2]uint32
 	cmdargs[0] = offset
 
-	chunkSize := idealChunkSize(n)
-	d.usb.SetReadChunkSize(chunkSize)
+	chunkSize := d.chunkSize(n)
+	if d.remote == nil && d.dry == nil {
+		d.mu.Lock()
+		d.usb.SetReadChunkSize(chunkSize)
+		d.mu.Unlock()
+	}
 	for n > 0 && ctx.Err() == nil {
 		sz := chunkSize
 		if int64(sz) > n {
@@ -335,7 +677,7 @@ func (d *Device) CmdDownload(ctx context.Context, w io.Writer, n int64, bank Ban
 
 		buf := make([]byte, paddedSz)
 		cmdargs[1] = uint32(bank)<<24 | uint32(paddedSz)
-		if err := d.SendCmd(CmdDumpToPc, cmdargs[:], nil, buf); err != nil {
+		if err := d.SendCmd(ctx, CmdDumpToPc, cmdargs[:], nil, buf); err != nil {
 			return err
 		}
 
@@ -343,7 +685,7 @@ func (d *Device) CmdDownload(ctx context.Context, w io.Writer, n int64, bank Ban
 		if err != nil {
 			return err
 		} else if read != sz {
-			panic("provided writer does not respect io.Writer interface")
+			return ErrShortWriter
 		}
 
 		cmdargs[0] += uint32(read)
@@ -357,64 +699,121 @@ func (d *Device) CmdDownload(ctx context.Context, w io.Writer, n int64, bank Ban
 // in BankCARTROM at offset 0. The upgrade happens in background; use CmdUpgradeReport to
 // get a report on the status of the upgrade.
 // NOTE: removing power during an upgrade might brick the 64drive unit.
-func (d *Device) CmdUpgradeStart() error {
-	return d.SendCmd(CmdUpgradeStart, nil, nil, nil)
+func (d *Device) CmdUpgradeStart(ctx context.Context) error {
+	return d.SendCmd(ctx, CmdUpgradeStart, nil, nil, nil)
 }
 
 // CmdUpgradeReport reports the status of an ongoing firmware update
-func (d *Device) CmdUpgradeReport() (UpgradeStatus, error) {
+func (d *Device) CmdUpgradeReport(ctx context.Context) (UpgradeStatus, error) {
 	var buf [4]byte
-	if err := d.SendCmd(CmdUpgradeReport, nil, nil, buf[:]); err != nil {
+	if err := d.SendCmd(ctx, CmdUpgradeReport, nil, nil, buf[:]); err != nil {
 		return 0, err
 	}
 	val := binary.BigEndian.Uint32(buf[:])
 	return UpgradeStatus(val & 0xF), nil
 }
 
+// CmdFifoRead reads a packet sent by the N64 through the USB FIFO, blocking
+// until a packet is received or ctx is canceled. The device is locked only while
+// a packet is being read, so other commands can be issued concurrently.
+// It returns ErrUnsupported if the firmware has no debug FIFO (see FeatureDebugFifo).
 func (d *Device) CmdFifoRead(ctx context.Context) (typ uint8, data []byte, err error) {
-	var head [4]byte
-	var n int
-
+	if err = d.require(ctx, FeatureDebugFifo); err != nil {
+		return
+	}
 	for ctx.Err() == nil {
-		if _, err = d.usb.Read(head[:]); err == nil {
-			break
-		} else if err == ErrFrozen {
-			// No data received. Hopefully it's not really frozen but simply
-			// idle. Try again.
-			continue
+		d.mu.Lock()
+		if d.remote != nil {
+			typ, data, err = d.remote.fifoRead(ctx)
 		} else {
+			typ, data, err = d.fifoRead(ctx)
+		}
+		d.mu.Unlock()
+		if err != ErrFrozen {
 			return
 		}
+		// No data received. Hopefully it's not really frozen but simply
+		// idle. Try again.
 	}
-	if ctx.Err() != nil {
-		err = ctx.Err()
-		return
-	}
+	err = ctx.Err()
+	return
+}
 
-	if string(head[:]) != "DMA@" {
-		err = ErrInvalidFifoHead
-		return
+// Size of the header ("DMA@", type and size) and trailer ("CMPH") of a FIFO packet
+const (
+	fifoHeadSize    = 8
+	fifoTrailerSize = 4
+)
+
+// fifoRead tries reading a single FIFO packet. It returns ErrFrozen if no
+// data is available. Must be called with d.mu held.
+//
+// If ctx expires while a packet is being received (eg: at the poll deadline of
+// a daemon client), the bytes received so far are kept in d.fifo and the next
+// call completes the packet, so that the FIFO stream doesn't go out of sync.
+func (d *Device) fifoRead(ctx context.Context) (typ uint8, data []byte, err error) {
+	_, hasDeadline := ctx.Deadline()
+
+	// fill reads into d.fifo until it contains n bytes, like readFull
+	fill := func(n int) error {
+		if cap(d.fifo) < n {
+			d.fifo = append(make([]byte, 0, n), d.fifo...)
+		}
+		for len(d.fifo) < n {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			m, err := d.usb.Read(d.fifo[len(d.fifo):n])
+			d.fifo = d.fifo[:len(d.fifo)+m]
+			if err == ErrFrozen && hasDeadline {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
 	}
 
-	var size [4]byte
-	if n, err = d.usb.Read(size[:]); err != nil || n != 4 {
-		err = fmt.Errorf("USB FIFO Read: invalid packet size")
-		return
+	// fail discards the packet being received, unless ctx expired
+	fail := func(err error, msg string) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		d.fifo = nil
+		return fmt.Errorf("%w: %v", ErrProtocol, msg)
 	}
 
-	typ = size[0]
-	len := (int(size[1]) << 16) | (int(size[2]) << 8) | int(size[3])
-	data = make([]byte, len)
-	if n, err = d.usb.Read(data); err != nil || n != len {
-		err = fmt.Errorf("USB FIFO Read: invalid short packet")
-		return
+	if len(d.fifo) == 0 {
+		// No packet in progress: if no data is available, return ErrFrozen
+		var head [4]byte
+		n, err := d.usb.Read(head[:])
+		if n == 0 {
+			return 0, nil, err
+		}
+		d.fifo = append(d.fifo, head[:n]...)
 	}
 
-	if _, err = d.usb.Read(head[:]); err != nil || string(head[:]) != "CMPH" {
-		err = fmt.Errorf("USB FIFO Read: invalid short packet")
-		return
+	if err = fill(4); err != nil {
+		return 0, nil, fail(err, "truncated FIFO packet header")
+	}
+	if string(d.fifo[:4]) != "DMA@" {
+		d.fifo = nil
+		return 0, nil, ErrInvalidFifoHead
+	}
+	if err = fill(fifoHeadSize); err != nil {
+		return 0, nil, fail(err, "missing FIFO packet size")
+	}
+	typ = d.fifo[4]
+	size := int(d.fifo[5])<<16 | int(d.fifo[6])<<8 | int(d.fifo[7])
+	if err = fill(fifoHeadSize + size + fifoTrailerSize); err != nil {
+		return 0, nil, fail(err, "short FIFO packet")
 	}
 
-	err = ctx.Err()
-	return
+	pkt := d.fifo
+	d.fifo = nil
+	if string(pkt[fifoHeadSize+size:]) != "CMPH" {
+		return 0, nil, fmt.Errorf("%w: invalid FIFO packet trailer", ErrProtocol)
+	}
+	return typ, pkt[fifoHeadSize : fifoHeadSize+size], nil
 }
@@ -0,0 +1,143 @@
+package drive64
+
+import (
+	"context"
+	"encoding/binary"
+)
+
+// DryRunCmd describes a command sent to a device in dry-run mode (see Device.DryRun)
+type DryRunCmd struct {
+	Cmd      Cmd
+	Args     []uint32
+	In       []byte // Payload sent after the arguments
+	OutSize  int    // Size of the response
+	Executed bool   // True if the command was actually executed, because it is read-only
+}
+
+// Bank returns the bank and the range accessed by a CmdLoadFromPc or CmdDumpToPc command
+func (c DryRunCmd) Bank() (bank Bank, offset uint32, size int, ok bool) {
+	if (c.Cmd != CmdLoadFromPc && c.Cmd != CmdDumpToPc) || len(c.Args) != 2 {
+		return 0, 0, 0, false
+	}
+	return Bank(c.Args[1] >> 24), c.Args[0], int(c.Args[1] & 0xFFFFFF), true
+}
+
+// dryRunWrite is a memory write that was not executed in dry-run mode
+type dryRunWrite struct {
+	bank   Bank
+	offset uint32
+	data   []byte
+}
+
+// dryRun is the state of a device in dry-run mode
+type dryRun struct {
+	parent    *Device
+	log       func(DryRunCmd)
+	writes    []dryRunWrite
+	upgrading bool
+}
+
+// DryRun returns a Device that doesn't send commands that change the state of d,
+// and reports all commands to log instead. This can be used to check which commands
+// an operation would send.
+//
+// Read-only commands (CmdVersionRequest and CmdDumpToPc) are still executed on d.
+// Memory writes are kept in the returned Device, and are visible to later reads,
+// so that operations that read back what they wrote (eg: autodetection from the ROM
+// header) work as usual. Firmware upgrades are simulated to complete successfully.
+//
+// The returned Device takes ownership of d: closing it closes d.
+func (d *Device) DryRun(log func(DryRunCmd)) *Device {
+	return &Device{
+		desc: d.desc,
+		dry:  &dryRun{parent: d, log: log},
+	}
+}
+
+// IsDryRun returns true if the device was created by DryRun
+func (d *Device) IsDryRun() bool {
+	return d.dry != nil
+}
+
+func (dr *dryRun) sendCmd(ctx context.Context, cmd Cmd, args []uint32, in []byte, out []byte) error {
+	entry := DryRunCmd{Cmd: cmd, Args: append([]uint32(nil), args...), In: in, OutSize: len(out)}
+	for i := range out {
+		out[i] = 0
+	}
+
+	switch cmd {
+	case CmdVersionRequest:
+		// Go through the parent, so that its cached version is used
+		entry.Executed = true
+		hwver, fwver, magic, err := dr.parent.CmdVersionRequest(ctx)
+		if err != nil {
+			return err
+		}
+		if len(out) >= 8 {
+			binary.BigEndian.PutUint16(out[0:2], uint16(hwver))
+			binary.BigEndian.PutUint16(out[2:4], uint16(fwver))
+			copy(out[4:8], magic[:])
+		}
+
+	case CmdDumpToPc:
+		bank, offset, _, _ := entry.Bank()
+		if !dr.read(bank, offset, out) {
+			entry.Executed = true
+			if err := dr.parent.SendCmd(ctx, cmd, args, in, out); err != nil {
+				return err
+			}
+			dr.read(bank, offset, out)
+		}
+
+	case CmdLoadFromPc:
+		bank, offset, size, _ := entry.Bank()
+		if size > len(in) {
+			size = len(in)
+		}
+		dr.writes = append(dr.writes, dryRunWrite{bank, offset, append([]byte(nil), in[:size]...)})
+
+	case CmdUpgradeStart:
+		dr.upgrading = true
+
+	case CmdUpgradeReport:
+		stat := UpgradeReady
+		if dr.upgrading {
+			stat = UpgradeSuccess
+		}
+		if len(out) >= 4 {
+			binary.BigEndian.PutUint32(out, uint32(stat))
+		}
+	}
+
+	dr.log(entry)
+	return nil
+}
+
+// read copies into buf the memory written at the specified bank and offset.
+// It returns true if buf was completely covered by previous writes.
+func (dr *dryRun) read(bank Bank, offset uint32, buf []byte) bool {
+	covered := make([]bool, len(buf))
+	for _, w := range dr.writes {
+		if w.bank != bank {
+			continue
+		}
+		start, end := int64(w.offset)-int64(offset), int64(w.offset)+int64(len(w.data))-int64(offset)
+		for i := maxInt64(start, 0); i < end && i < int64(len(buf)); i++ {
+			buf[i] = w.data[i-start]
+			covered[i] = true
+		}
+	}
+	for _, c := range covered {
+		if !c {
+			return false
+		}
+	}
+	return true
+}
+
+func maxInt64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
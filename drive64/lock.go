@@ -0,0 +1,55 @@
+package drive64
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// errLocked is returned by lockFile when the lock is held by another process.
+var errLocked = errors.New("file is locked")
+
+// runtimeDir returns the directory that holds the device locks and the daemon
+// sockets. It is private to the current user, so that other users cannot hold
+// the locks (blocking the devices) or talk to the daemons.
+func runtimeDir() (string, error) {
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir != "" {
+		dir = filepath.Join(dir, "g64drive")
+	} else if uid := os.Getuid(); uid != -1 {
+		dir = filepath.Join(os.TempDir(), fmt.Sprintf("g64drive-%d", uid))
+	} else {
+		// On Windows, the temporary directory is already per-user
+		dir = filepath.Join(os.TempDir(), "g64drive")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	// The directory might have been created by someone else
+	if fi, err := os.Lstat(dir); err != nil {
+		return "", err
+	} else if !fi.IsDir() || !privateDir(fi) {
+		return "", fmt.Errorf("insecure runtime directory %v (it must be a directory accessible only by its owner)", dir)
+	}
+	return dir, nil
+}
+
+// lockDevice takes an exclusive lock on the device with the specified serial,
+// to make sure that only one process at a time talks to it. The lock is
+// released by closing the returned file.
+func lockDevice(serial string) (*os.File, error) {
+	dir, err := runtimeDir()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, serial+".lock"), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
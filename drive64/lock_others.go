@@ -0,0 +1,23 @@
+//go:build !windows
+
+package drive64
+
+import (
+	"os"
+	"syscall"
+)
+
+func lockFile(f *os.File) error {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return errLocked
+	}
+	return err
+}
+
+// privateDir returns true if the directory is owned by the current user,
+// and not accessible by anybody else.
+func privateDir(fi os.FileInfo) bool {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	return ok && int(st.Uid) == os.Getuid() && fi.Mode().Perm()&0077 == 0
+}
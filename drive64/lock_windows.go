@@ -0,0 +1,22 @@
+package drive64
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+func lockFile(f *os.File) error {
+	err := windows.LockFileEx(windows.Handle(f.Fd()),
+		windows.LOCKFILE_EXCLUSIVE_LOCK|windows.LOCKFILE_FAIL_IMMEDIATELY, 0, 1, 0, new(windows.Overlapped))
+	if err == windows.ERROR_LOCK_VIOLATION {
+		return errLocked
+	}
+	return err
+}
+
+// privateDir returns true if the directory is private to the current user.
+// On Windows, the temporary directory is already per-user.
+func privateDir(fi os.FileInfo) bool {
+	return true
+}
@@ -0,0 +1,217 @@
+package drive64
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	lzf "github.com/zhuyie/golzf"
+	"gopkg.in/restruct.v1"
+)
+
+// ValidateRPK performs a deep validation of a RPK archive: it checks the integrity
+// of every blob (header, CRC, sizes, end-of-blob markers), the structure of the
+// archive, and the consistency of the metadata. Unlike NewRPKFromReader, it doesn't
+// stop at the first problem: it returns all the problems found, or nil if the
+// archive is valid.
+func ValidateRPK(r io.Reader) []error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return []error{err}
+	}
+
+	var c rpkChecker
+	br := bytes.NewReader(data)
+	root := c.blob(br, "")
+	if root == nil {
+		return c.errs
+	}
+	if br.Len() != 0 {
+		c.errorf("%d bytes of garbage after the root blob", br.Len())
+	}
+	if root.Head.Magic != rpkMagicRoot {
+		c.errorf("unknown root blob magic %q", root.Head.Magic[:])
+		return c.errs
+	}
+
+	rpk := new(RPK)
+	var metadata, asset *blob
+	for _, b := range root.Children {
+		var found **blob
+		switch b.Head.Magic {
+		case rpkMagicMetadata:
+			found = &metadata
+		case rpkMagicAsset:
+			found = &asset
+		default:
+			c.errorf("PF: unknown child blob %q", b.Head.Magic[:])
+			continue
+		}
+		if *found != nil {
+			c.errorf("PF: duplicate child blob %q", b.Head.Magic[:])
+			continue
+		}
+		*found = b
+		if len(b.Children) != 0 {
+			c.errorf("PF/%s: unexpected children blobs", b.Head.Magic[:])
+		}
+	}
+
+	if metadata == nil {
+		c.errorf("PF: missing metadata blob (PM)")
+	} else {
+		if size, err := restruct.SizeOf(&rpk.Metadata); err == nil && size != len(metadata.Body) {
+			c.errorf("PF/PM: metadata is %d bytes, expected %d", len(metadata.Body), size)
+		}
+		if err := restruct.Unpack(metadata.Body, binary.LittleEndian, &rpk.Metadata); err != nil {
+			c.errorf("PF/PM: cannot decode metadata: %v", err)
+		} else {
+			c.errs = append(c.errs, rpk.checkMetadata()...)
+		}
+	}
+
+	if asset == nil {
+		c.errorf("PF: missing asset blob (PA)")
+	} else if len(asset.Body) == 0 {
+		c.errorf("PF/PA: empty asset")
+	}
+
+	return c.errs
+}
+
+type rpkChecker struct {
+	errs []error
+}
+
+func (c *rpkChecker) errorf(format string, args ...interface{}) {
+	c.errs = append(c.errs, fmt.Errorf(format, args...))
+}
+
+// blob parses a blob like newBlobFromReader, but reports all problems instead
+// of stopping at the first one. It returns nil only if the blob (and thus the
+// rest of the stream) cannot be parsed any further.
+func (c *rpkChecker) blob(r *bytes.Reader, parent string) *blob {
+	var h blobHead
+	if err := binary.Read(r, binary.LittleEndian, &h); err != nil {
+		c.errorf("%struncated blob header", parent)
+		return nil
+	}
+	path := parent + string(h.Magic[:])
+	if h.Magic[0] != 'P' {
+		c.errorf("%s: invalid blob magic", path)
+	}
+	if h.Version != '0' {
+		c.errorf("%s: unsupported blob version %q", path, h.Version)
+		return nil
+	}
+	if h.Compress != 'C' && h.Compress != 'U' {
+		c.errorf("%s: invalid compression %q", path, h.Compress)
+		return nil
+	}
+
+	if int64(h.Length) > int64(r.Len()) {
+		c.errorf("%s: truncated body (length is %d, %d bytes available)", path, h.Length, r.Len())
+		return nil
+	}
+	body := make([]byte, h.Length)
+	io.ReadFull(r, body)
+	if crc := crc32.ChecksumIEEE(body); crc != h.Crc {
+		c.errorf("%s: invalid CRC (%08x, expected %08x)", path, crc, h.Crc)
+	}
+
+	if h.Compress == 'C' {
+		if int64(h.ULength) > rpkMaxBlobSize {
+			c.errorf("%s: ULength %d is larger than the maximum blob size (%d)", path, h.ULength, rpkMaxBlobSize)
+			return nil
+		}
+		ubody := make([]byte, h.ULength)
+		n, err := lzf.Decompress(body, ubody)
+		if err != nil {
+			c.errorf("%s: cannot decompress body: %v", path, err)
+			return nil
+		}
+		if n != int(h.ULength) {
+			c.errorf("%s: uncompressed size is %d, but ULength is %d", path, n, h.ULength)
+		}
+		body = ubody[:n]
+	} else if h.ULength != 0 && h.ULength != h.Length {
+		// ULength is not meaningful for uncompressed blobs, but it must not be inconsistent
+		c.errorf("%s: uncompressed blob with Length %d and ULength %d", path, h.Length, h.ULength)
+	}
+
+	bodyR := bytes.NewReader(body)
+	var children []*blob
+	for i := uint32(0); i < h.Children; i++ {
+		b := c.blob(bodyR, path+"/")
+		if b == nil {
+			c.errorf("%s: found %d children, expected %d", path, i, h.Children)
+			return nil
+		}
+		children = append(children, b)
+	}
+	body = body[len(body)-bodyR.Len():]
+
+	var eob [4]byte
+	if _, err := io.ReadFull(r, eob[:]); err != nil || string(eob[:]) != "EOB\000" {
+		c.errorf("%s: invalid end-of-blob marker", path)
+	}
+
+	return &blob{h, body, children}
+}
+
+var rpkFieldSizeRe = regexp.MustCompile(`^\[(\d+)\]byte$`)
+
+// checkMetadata verifies that the metadata fields are consistent with each other,
+// and that they fit within the fixed-size fields of the binary format.
+func (rpk *RPK) checkMetadata() []error {
+	var errs []error
+	errorf := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("metadata: "+format, args...))
+	}
+	m := &rpk.Metadata
+
+	v := reflect.ValueOf(m).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		if f.Type.Kind() != reflect.String {
+			continue
+		}
+		if sm := rpkFieldSizeRe.FindStringSubmatch(f.Tag.Get("struct")); sm != nil {
+			if size, _ := strconv.Atoi(sm[1]); len(v.Field(i).String()) > size {
+				errorf("%s is too long (%d bytes, max %d)", f.Name, len(v.Field(i).String()), size)
+			}
+		}
+	}
+
+	switch m.Type {
+	case RPKAssetBootloader, RPKAssetFirmware:
+		if !strings.EqualFold(m.TypeText, m.Type.String()) {
+			errorf("TypeText %q does not match Type %v", m.TypeText, m.Type)
+		}
+	default:
+		errorf("unknown Type %d", uint32(m.Type))
+	}
+	if m.Product == "" {
+		errorf("Product is empty")
+	}
+	if len(m.Magic) != 4 {
+		errorf("Magic %q must be 4 characters", m.Magic)
+	}
+	if len(m.Variant) < 1 || len(m.Variant) > 2 {
+		errorf("Variant %q must be 1 or 2 characters", m.Variant)
+	}
+	if vers, err := NewVersionFromString(m.ContentVersionText); err != nil || vers != Version(m.ContentVersion) {
+		errorf("ContentVersionText %q does not match ContentVersion %v", m.ContentVersionText, Version(m.ContentVersion))
+	}
+	if _, err := rpk.RequiredVersion(); err != nil {
+		errorf("%v", err)
+	}
+	return errs
+}
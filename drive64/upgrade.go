@@ -3,12 +3,13 @@ package drive64
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"hash/crc32"
 	"io"
 	"io/ioutil"
-	"os"
+	"regexp"
 	"strings"
 
 	"github.com/mitchellh/go-wordwrap"
@@ -26,6 +27,10 @@ type blobHead struct {
 	Crc      uint32
 }
 
+// rpkMaxBlobSize is the maximum uncompressed size of a blob. The asset is
+// uploaded to CARTROM for flashing, so nothing larger can be a valid RPK.
+var rpkMaxBlobSize = BankCARTROM.Info().Capacity(VarRevB, true)
+
 type blob struct {
 	Head     blobHead
 	Body     []uint8
@@ -53,6 +58,9 @@ func newBlobFromReader(r io.Reader) (*blob, error) {
 
 	// Decompress the full body (if required)
 	if h.Compress == 'C' {
+		if int64(h.ULength) > rpkMaxBlobSize {
+			return nil, errors.New("invalid uncompressed size in blob")
+		}
 		ubody := make([]byte, h.ULength)
 		if n, err := lzf.Decompress(body, ubody); err != nil {
 			return nil, err
@@ -90,6 +98,53 @@ func newBlobFromReader(r io.Reader) (*blob, error) {
 	return &blob{h, body, children}, nil
 }
 
+// encode serializes the blob and its children, filling in the header fields.
+// If Head.Compress is 'C', the body is compressed with LZF, unless it turns
+// out to be incompressible (in which case it is stored uncompressed).
+func (b *blob) encode() ([]byte, error) {
+	var ubody bytes.Buffer
+	for _, c := range b.Children {
+		data, err := c.encode()
+		if err != nil {
+			return nil, err
+		}
+		ubody.Write(data)
+	}
+	ubody.Write(b.Body)
+
+	h := b.Head
+	h.Version = '0'
+	h.Children = uint32(len(b.Children))
+	h.ULength = uint32(ubody.Len())
+	body := ubody.Bytes()
+	// golzf reads past the end of inputs shorter than 3 bytes, which cannot
+	// be compressed anyway
+	if h.Compress == 'C' && len(body) < 3 {
+		h.Compress = 'U'
+	}
+	if h.Compress == 'C' {
+		cbody := make([]byte, len(body))
+		if n, err := lzf.Compress(body, cbody); err == nil && n > 0 && n < len(body) {
+			body = cbody[:n]
+		} else {
+			h.Compress = 'U'
+		}
+	}
+	if h.Compress != 'C' && h.Compress != 'U' {
+		return nil, errors.New("invalid blob compression")
+	}
+	h.Length = uint32(len(body))
+	h.Crc = crc32.ChecksumIEEE(body)
+
+	var out bytes.Buffer
+	if err := binary.Write(&out, binary.LittleEndian, &h); err != nil {
+		return nil, err
+	}
+	out.Write(body)
+	out.WriteString("EOB\000")
+	return out.Bytes(), nil
+}
+
 // RPKAssetType identifies the type of asset that can be stored within a RPK archive
 type RPKAssetType uint32
 
@@ -100,29 +155,47 @@ const (
 	RPKAssetFirmware RPKAssetType = 2
 )
 
+func (t RPKAssetType) String() string {
+	switch t {
+	case RPKAssetBootloader:
+		return "Bootloader"
+	case RPKAssetFirmware:
+		return "Firmware"
+	default:
+		return fmt.Sprintf("RPKAssetType(%d)", uint32(t))
+	}
+}
+
+// Magic of the blobs that make up a RPK archive
+var (
+	rpkMagicRoot     = [2]byte{'P', 'F'}
+	rpkMagicMetadata = [2]byte{'P', 'M'}
+	rpkMagicAsset    = [2]byte{'P', 'A'}
+)
+
 type RPK struct {
 	Metadata struct {
-		Format      uint32
-		Copyright   string `struct:"[64]byte"`
-		Date        string `struct:"[32]byte"`
-		File        string `struct:"[64]byte"`
-		Type        RPKAssetType
-		TypeText    string `struct:"[32]byte"`
-		Product     string `struct:"[16]byte"`
-		ProductText string `struct:"[64]byte"`
-		Device      string `struct:"[32]byte"`
-		Magic       string `struct:"[16]byte"`
-		Variant     string `struct:"[8]byte"`
-
-		ContentVersion        uint16
-		ContentVersionSpecial uint8
-		ContentVersionText    string `struct:"[16]byte"`
-		Prerequisites         uint32 `struct:"skip=1"`
-		PrerequisitesText     string `struct:"[128]byte"`
-		ContentNote           string `struct:"[128]byte"`
-		ContentChanges        string `struct:"[1024]byte"`
-		ContentErrata         string `struct:"[128]byte"`
-		ContentExtra          string `struct:"[128]byte"`
+		Format      uint32       `json:"format"`
+		Copyright   string       `struct:"[64]byte" json:"copyright"`
+		Date        string       `struct:"[32]byte" json:"date"`
+		File        string       `struct:"[64]byte" json:"file"`
+		Type        RPKAssetType `json:"type"`
+		TypeText    string       `struct:"[32]byte" json:"type_text"`
+		Product     string       `struct:"[16]byte" json:"product"`
+		ProductText string       `struct:"[64]byte" json:"product_text"`
+		Device      string       `struct:"[32]byte" json:"device"`
+		Magic       string       `struct:"[16]byte" json:"magic"`
+		Variant     string       `struct:"[8]byte" json:"variant"`
+
+		ContentVersion        uint16 `json:"content_version"`
+		ContentVersionSpecial uint8  `json:"content_version_special"`
+		ContentVersionText    string `struct:"[16]byte" json:"content_version_text"`
+		Prerequisites         uint32 `struct:"skip=1" json:"-"`
+		PrerequisitesText     string `struct:"[128]byte" json:"prerequisites_text"`
+		ContentNote           string `struct:"[128]byte" json:"content_note"`
+		ContentChanges        string `struct:"[1024]byte" json:"content_changes"`
+		ContentErrata         string `struct:"[128]byte" json:"content_errata"`
+		ContentExtra          string `struct:"[128]byte" json:"content_extra"`
 	}
 	Asset []byte
 }
@@ -133,10 +206,11 @@ func NewRPKFromReader(r io.Reader) (*RPK, error) {
 		return nil, err
 	}
 
-	if root.Head.Magic[1] != 'F' {
+	if root.Head.Magic != rpkMagicRoot {
 		return nil, errors.New("unexpected root blob with magic " + string(root.Head.Magic[:]))
 	}
 
+	// Unknown children blobs are skipped; ValidateRPK reports them.
 	rpk := new(RPK)
 	foundMetadata := false
 	foundAsset := false
@@ -168,8 +242,84 @@ func NewRPKFromReader(r io.Reader) (*RPK, error) {
 	return rpk, nil
 }
 
-func (rpk *RPK) DumpMetadata() {
-	w := os.Stdout
+var rpkVersionRe = regexp.MustCompile(`\b\d+\.\d\d\b`)
+
+// RequiredVersion parses the prerequisites of the RPK and returns the minimum
+// firmware version that must be installed on the 64drive to flash it. It returns
+// zero if there are no prerequisites. The prerequisites are only described by
+// PrerequisitesText (eg: "2.05" or "Firmware 2.04 or later"); if more than one
+// version is mentioned, the highest one is required.
+func (rpk *RPK) RequiredVersion() (Version, error) {
+	text := strings.TrimSpace(rpk.Metadata.PrerequisitesText)
+	if text == "" || strings.EqualFold(text, "none") {
+		return 0, nil
+	}
+	var req Version
+	for _, m := range rpkVersionRe.FindAllString(text, -1) {
+		v, err := NewVersionFromString(m)
+		if err != nil {
+			return 0, err
+		}
+		if v > req {
+			req = v
+		}
+	}
+	if req == 0 {
+		return 0, fmt.Errorf("cannot parse prerequisites: %q", text)
+	}
+	return req, nil
+}
+
+// WriteTo serializes the RPK archive into w. It implements io.WriterTo.
+// The metadata is checked for consistency before writing.
+func (rpk *RPK) WriteTo(w io.Writer) (int64, error) {
+	if errs := rpk.checkMetadata(); len(errs) != 0 {
+		return 0, errs[0]
+	}
+	if len(rpk.Asset) == 0 {
+		return 0, errors.New("empty asset")
+	}
+	meta, err := restruct.Pack(binary.LittleEndian, &rpk.Metadata)
+	if err != nil {
+		return 0, err
+	}
+
+	root := &blob{
+		Head: blobHead{Magic: rpkMagicRoot, Compress: 'U'},
+		Children: []*blob{
+			{Head: blobHead{Magic: rpkMagicMetadata, Compress: 'U'}, Body: meta},
+			{Head: blobHead{Magic: rpkMagicAsset, Compress: 'C'}, Body: rpk.Asset},
+		},
+	}
+	data, err := root.encode()
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(data)
+	return int64(n), err
+}
+
+// MetadataFormat is the format used by DumpMetadata
+type MetadataFormat int
+
+const (
+	// MetadataText is a human-readable table
+	MetadataText MetadataFormat = iota
+	// MetadataJSON is a JSON object
+	MetadataJSON
+)
+
+// DumpMetadata writes the RPK metadata into w, in the specified format
+func (rpk *RPK) DumpMetadata(w io.Writer, format MetadataFormat) error {
+	if format == MetadataJSON {
+		data, err := json.Marshal(&rpk.Metadata)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(data, '\n'))
+		return err
+	}
+
 	const sfmt = "%-18s | "
 	const sep = "---------------------------------------------------------------------------------"
 
@@ -204,4 +354,5 @@ func (rpk *RPK) DumpMetadata() {
 	dumpField("Content Changes", rpk.Metadata.ContentChanges)
 	dumpField("Content Errata", rpk.Metadata.ContentErrata)
 	dumpField("Content Extra", rpk.Metadata.ContentExtra)
+	return nil
 }
@@ -0,0 +1,253 @@
+package drive64
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testRPK returns a firmware RPK with consistent metadata
+func testRPK(asset []byte) *RPK {
+	rpk := &RPK{Asset: asset}
+	m := &rpk.Metadata
+	m.Format = 1
+	m.Copyright = "(c) 2018 Retroactive LLC"
+	m.Date = "2018-01-04"
+	m.File = "firmware.bin"
+	m.Type = RPKAssetFirmware
+	m.TypeText = "Firmware"
+	m.Product = "64drive"
+	m.ProductText = "64drive"
+	m.Device = "EP4CE10F17"
+	m.Magic = "UDEV"
+	m.Variant = "B"
+	m.ContentVersion = 205
+	m.ContentVersionText = "2.05"
+	m.PrerequisitesText = "2.00"
+	m.ContentNote = "Adds support for USB communication from N64."
+	return rpk
+}
+
+// Offsets of the fields within a blob header
+const (
+	blobHeadSize   = 20
+	blobLengthOff  = 8
+	blobULengthOff = 12
+	blobCrcOff     = 16
+	blobEOBMarkLen = 4
+)
+
+// packRPK serializes rpk, failing the test on error
+func packRPK(t *testing.T, rpk *RPK) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	n, err := rpk.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(buf.Len()) {
+		t.Fatalf("WriteTo returned %d, but wrote %d bytes", n, buf.Len())
+	}
+	return buf.Bytes()
+}
+
+// fixRootCRC recomputes the CRC of the root blob, so that corruptions of the
+// children blobs are not detected by the root CRC.
+func fixRootCRC(data []byte) {
+	length := binary.LittleEndian.Uint32(data[blobLengthOff:])
+	crc := crc32.ChecksumIEEE(data[blobHeadSize : blobHeadSize+length])
+	binary.LittleEndian.PutUint32(data[blobCrcOff:], crc)
+}
+
+func TestRPKRoundTrip(t *testing.T) {
+	random := make([]byte, 64*1024)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	tests := []struct {
+		name     string
+		asset    []byte
+		compress byte
+	}{
+		{"compressible", bytes.Repeat([]byte("64drive firmware "), 4096), 'C'},
+		{"incompressible", random, 'U'},
+		{"single byte", []byte{0x42}, 'U'},
+	}
+	for _, tt := range tests {
+		rpk := testRPK(tt.asset)
+		data := packRPK(t, rpk)
+
+		root, err := newBlobFromReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%s: cannot parse blobs: %v", tt.name, err)
+		}
+		if len(root.Children) != 2 {
+			t.Fatalf("%s: %d children blobs, expected 2", tt.name, len(root.Children))
+		}
+		if c := root.Children[1].Head.Compress; c != tt.compress {
+			t.Errorf("%s: asset compression is %q, expected %q", tt.name, c, tt.compress)
+		}
+
+		rpk2, err := NewRPKFromReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%s: cannot parse RPK: %v", tt.name, err)
+		}
+		if !bytes.Equal(rpk2.Asset, tt.asset) {
+			t.Errorf("%s: asset differs after round trip", tt.name)
+		}
+		if !reflect.DeepEqual(rpk2.Metadata, rpk.Metadata) {
+			t.Errorf("%s: metadata differs after round trip:\n%+v\n%+v", tt.name, rpk2.Metadata, rpk.Metadata)
+		}
+
+		if errs := ValidateRPK(bytes.NewReader(data)); errs != nil {
+			t.Errorf("%s: valid RPK reported as invalid: %v", tt.name, errs)
+		}
+
+		// Packing again gives the same archive
+		if !bytes.Equal(packRPK(t, rpk2), data) {
+			t.Errorf("%s: archive differs after round trip", tt.name)
+		}
+	}
+}
+
+func TestRPKCorrupted(t *testing.T) {
+	tests := []struct {
+		name     string
+		compress bool
+		corrupt  func(data []byte) []byte
+		err      string // expected error of NewRPKFromReader (empty: no error)
+		validate string // expected error of ValidateRPK
+	}{
+		{"root CRC", true, func(data []byte) []byte {
+			data[len(data)-blobEOBMarkLen-1] ^= 0xFF
+			return data
+		}, "invalid CRC", "PF: invalid CRC"},
+		{"compressed asset CRC", true, func(data []byte) []byte {
+			// The asset blob is the last child, so its body ends right before
+			// the end-of-blob markers of the asset and of the root.
+			data[len(data)-2*blobEOBMarkLen-1] ^= 0xFF
+			fixRootCRC(data)
+			return data
+		}, "invalid CRC", "PF/PA: invalid CRC"},
+		{"uncompressed asset CRC", false, func(data []byte) []byte {
+			data[len(data)-2*blobEOBMarkLen-1] ^= 0xFF
+			fixRootCRC(data)
+			return data
+		}, "invalid CRC", "PF/PA: invalid CRC"},
+		{"metadata CRC", true, func(data []byte) []byte {
+			data[2*blobHeadSize] ^= 0xFF
+			fixRootCRC(data)
+			return data
+		}, "invalid CRC", "PF/PM: invalid CRC"},
+		{"truncated header", true, func(data []byte) []byte {
+			return data[:blobHeadSize/2]
+		}, "EOF", "truncated blob header"},
+		{"truncated body", true, func(data []byte) []byte {
+			return data[:len(data)/2]
+		}, "EOF", "PF: truncated body"},
+		{"truncated end-of-blob marker", false, func(data []byte) []byte {
+			return data[:len(data)-2]
+		}, "EOF", "PF: invalid end-of-blob marker"},
+		{"invalid end-of-blob marker", false, func(data []byte) []byte {
+			data[len(data)-1] = 'X'
+			return data
+		}, "invalid end-of-blob marker", "PF: invalid end-of-blob marker"},
+		{"trailing garbage", false, func(data []byte) []byte {
+			return append(data, "garbage"...)
+		}, "", "7 bytes of garbage after the root blob"},
+		{"oversized ULength", true, func(data []byte) []byte {
+			// The asset blob follows the root header and the metadata blob
+			metaLen := binary.LittleEndian.Uint32(data[blobHeadSize+blobLengthOff:])
+			asset := 2*blobHeadSize + int(metaLen) + blobEOBMarkLen
+			binary.LittleEndian.PutUint32(data[asset+blobULengthOff:], 0xFFFFFFFF)
+			fixRootCRC(data)
+			return data
+		}, "invalid uncompressed size", "PF/PA: ULength 4294967295 is larger than the maximum blob size"},
+		{"unknown child blob", false, func(data []byte) []byte {
+			data[blobHeadSize+1] = 'X' // metadata is the first child
+			fixRootCRC(data)
+			return data
+		}, "", `PF: unknown child blob "PX"`},
+		{"invalid blob version", false, func(data []byte) []byte {
+			data[2] = '1'
+			return data
+		}, "invalid blob header", "unsupported blob version"},
+	}
+	for _, tt := range tests {
+		asset := bytes.Repeat([]byte{0xAA, 0x55}, 1024)
+		if !tt.compress {
+			asset = make([]byte, 4096)
+			rand.New(rand.NewSource(2)).Read(asset)
+		}
+		data := tt.corrupt(packRPK(t, testRPK(asset)))
+
+		_, err := NewRPKFromReader(bytes.NewReader(data))
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%s: error is %v, expected %q", tt.name, err, tt.err)
+		}
+
+		errs := ValidateRPK(bytes.NewReader(data))
+		found := false
+		for _, err := range errs {
+			found = found || strings.Contains(err.Error(), tt.validate)
+		}
+		if !found {
+			t.Errorf("%s: ValidateRPK returned %v, expected %q", tt.name, errs, tt.validate)
+		}
+	}
+}
+
+func TestRPKWriteToInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(rpk *RPK)
+		err    string
+	}{
+		{"empty asset", func(rpk *RPK) { rpk.Asset = nil }, "empty asset"},
+		{"long field", func(rpk *RPK) { rpk.Metadata.Magic = strings.Repeat("X", 17) }, "Magic is too long"},
+		{"unknown type", func(rpk *RPK) { rpk.Metadata.Type = 7 }, "unknown Type"},
+		{"type text", func(rpk *RPK) { rpk.Metadata.TypeText = "Bootloader" }, "does not match Type"},
+		{"version text", func(rpk *RPK) { rpk.Metadata.ContentVersionText = "2.06" }, "does not match ContentVersion"},
+		{"prerequisites", func(rpk *RPK) { rpk.Metadata.PrerequisitesText = "latest" }, "cannot parse prerequisites"},
+	}
+	for _, tt := range tests {
+		rpk := testRPK([]byte{1, 2, 3, 4})
+		tt.modify(rpk)
+		var buf bytes.Buffer
+		if _, err := rpk.WriteTo(&buf); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: error is %v, expected %q", tt.name, err, tt.err)
+		}
+		if buf.Len() != 0 {
+			t.Errorf("%s: %d bytes written on error", tt.name, buf.Len())
+		}
+	}
+}
+
+func TestRPKRequiredVersion(t *testing.T) {
+	tests := []struct {
+		text string
+		want Version
+		err  bool
+	}{
+		{"", 0, false},
+		{"None", 0, false},
+		{"2.05", 205, false},
+		{"Firmware 2.04 or later", 204, false},
+		{"Bootloader 1.10 and firmware 2.05", 205, false},
+		{"latest", 0, true},
+	}
+	for _, tt := range tests {
+		rpk := testRPK(nil)
+		rpk.Metadata.PrerequisitesText = tt.text
+		v, err := rpk.RequiredVersion()
+		if (err != nil) != tt.err || v != tt.want {
+			t.Errorf("%q: got %v, %v; expected %v (error: %v)", tt.text, v, err, tt.want, tt.err)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package drive64
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"time"
+)
+
+// UpgradePhase is a phase of a firmware (or bootloader) upgrade
+type UpgradePhase int
+
+const (
+	// PhaseUpload is the transfer of the asset to the 64drive SDRAM
+	PhaseUpload UpgradePhase = iota
+	// PhaseReadback is the readback of the asset, to verify the transfer
+	PhaseReadback
+	// PhaseVerify is the verification of the asset by the 64drive
+	PhaseVerify
+	// PhaseErase is the erasure of the flash memory
+	PhaseErase
+	// PhaseWrite is the programming of the flash memory
+	PhaseWrite
+	// PhaseDone means that the upgrade completed successfully
+	PhaseDone
+)
+
+func (p UpgradePhase) String() string {
+	switch p {
+	case PhaseUpload:
+		return "Uploading"
+	case PhaseReadback:
+		return "Reading back"
+	case PhaseVerify:
+		return "Verifying"
+	case PhaseErase:
+		return "Erasing"
+	case PhaseWrite:
+		return "Flashing"
+	case PhaseDone:
+		return "Finished"
+	default:
+		return fmt.Sprintf("UpgradePhase(%d)", int(p))
+	}
+}
+
+// UpgradeEvent reports the progress of an upgrade
+type UpgradeEvent struct {
+	Phase   UpgradePhase
+	Percent int // Completion of the current phase (0-100)
+}
+
+// UpgradeCallbacks are the (optional) callbacks invoked by UpgradeFirmware
+type UpgradeCallbacks struct {
+	// Progress is called every time the phase or its completion changes
+	Progress func(ev UpgradeEvent)
+	// Confirm is called after the asset was transferred and verified, right before
+	// the flash memory is modified. If it returns false, the upgrade is aborted
+	// with ErrUpgradeAborted. If nil, the upgrade proceeds without confirmation.
+	Confirm func() bool
+}
+
+// UpgradeError is returned by UpgradeFirmware when the 64drive reports that
+// the upgrade failed. Status is one of UpgradeGeneralFail, UpgradeBadVariant
+// or UpgradeVerifyFail.
+type UpgradeError struct {
+	Status UpgradeStatus
+}
+
+func (e *UpgradeError) Error() string {
+	switch e.Status {
+	case UpgradeGeneralFail:
+		return "upgrade failed: general failure"
+	case UpgradeBadVariant:
+		return "upgrade failed: wrong hardware variant"
+	case UpgradeVerifyFail:
+		return "upgrade failed: verification failure"
+	default:
+		return fmt.Sprintf("upgrade failed: unexpected status %v", e.Status)
+	}
+}
+
+var (
+	// ErrBootloaderUpgrade is returned for bootloader RPKs. The command sequence
+	// that flashes a bootloader, and the firmware version that supports it, are
+	// not documented, and a wrong command might brick the unit (recovery requires
+	// JTAG), so bootloader upgrades are refused until both are known.
+	ErrBootloaderUpgrade = fmt.Errorf("%w: bootloader upgrade not implemented", ErrUnsupported)
+
+	ErrUpgradeAborted = errors.New("upgrade aborted")
+	ErrUpgradeStuck   = errors.New("upgrade is not progressing -- power-cycle your 64drive unit and retry")
+)
+
+const (
+	// Maximum time a single CmdUpgradeReport can take
+	upgradeReportTimeout = 5 * time.Second
+	// Maximum time the upgrade status can stay unchanged
+	upgradeStallTimeout = 60 * time.Second
+	// Interval between two CmdUpgradeReport
+	upgradePollInterval = 100 * time.Millisecond
+)
+
+// upgradeProgress maps the status reported by the 64drive to an event
+var upgradeProgress = map[UpgradeStatus]UpgradeEvent{
+	UpgradeVerifying: {PhaseVerify, 0},
+	UpgradeErasing00: {PhaseErase, 0},
+	UpgradeErasing25: {PhaseErase, 25},
+	UpgradeErasing50: {PhaseErase, 50},
+	UpgradeErasing75: {PhaseErase, 75},
+	UpgradeWriting00: {PhaseWrite, 0},
+	UpgradeWriting25: {PhaseWrite, 25},
+	UpgradeWriting50: {PhaseWrite, 50},
+	UpgradeWriting75: {PhaseWrite, 75},
+	UpgradeSuccess:   {PhaseDone, 100},
+}
+
+// CheckDevice verifies that the RPK is meant for the specified 64drive,
+// by comparing the product magic and the hardware variant.
+func (rpk *RPK) CheckDevice(ctx context.Context, dev *Device) error {
+	hwvar, _, magic, err := dev.CmdVersionRequest(ctx)
+	if err != nil {
+		return err
+	}
+	return rpk.CheckCompatible(hwvar, magic)
+}
+
+// CheckCompatible verifies that the RPK is meant for a 64drive with the specified
+// hardware variant and product magic (as returned by CmdVersionRequest).
+func (rpk *RPK) CheckCompatible(hwvar Variant, magic [4]byte) error {
+	if len(rpk.Metadata.Magic) < 4 || !bytes.Equal(magic[:], []byte(rpk.Metadata.Magic)[:4]) {
+		return fmt.Errorf("%w (different product)", ErrWrongDevice)
+	}
+	v := []byte(rpk.Metadata.Variant + "\000")[:2]
+	if hwvar != Variant(binary.BigEndian.Uint16(v)) {
+		return fmt.Errorf("%w (different hardware variant)", ErrWrongDevice)
+	}
+	return nil
+}
+
+// progressCounter counts the bytes going through it, and reports the completion percentage
+type progressCounter struct {
+	n, total int64
+	pct      int
+	report   func(pct int)
+}
+
+func (pc *progressCounter) add(n int) {
+	pc.n += int64(n)
+	if pct := int(pc.n * 100 / pc.total); pct != pc.pct {
+		pc.pct = pct
+		pc.report(pct)
+	}
+}
+
+func (pc *progressCounter) Write(buf []byte) (int, error) {
+	pc.add(len(buf))
+	return len(buf), nil
+}
+
+// UpgradeFirmware flashes the firmware contained in the RPK (bootloader RPKs are
+// refused with ErrBootloaderUpgrade).
+// The asset is uploaded to CARTROM and read back to verify the transfer; then,
+// after cb.Confirm (if any) agrees, the 64drive flashes it. Progress is reported
+// through cb.Progress.
+//
+// If the 64drive reports a failure, an *UpgradeError is returned. If the upgrade
+// status doesn't change for a long time, ErrUpgradeStuck is returned.
+// Notice that canceling ctx after the flashing started doesn't stop the 64drive,
+// it only stops monitoring it.
+func UpgradeFirmware(ctx context.Context, dev *Device, rpk *RPK, cb UpgradeCallbacks) error {
+	progress := func(phase UpgradePhase, pct int) {
+		if cb.Progress != nil {
+			cb.Progress(UpgradeEvent{phase, pct})
+		}
+	}
+
+	switch rpk.Metadata.Type {
+	case RPKAssetFirmware:
+	case RPKAssetBootloader:
+		return ErrBootloaderUpgrade
+	default:
+		return fmt.Errorf("unknown asset type: %s (%08x)", rpk.Metadata.TypeText, uint32(rpk.Metadata.Type))
+	}
+	if len(rpk.Asset) == 0 {
+		return errors.New("empty asset")
+	}
+	if err := rpk.CheckDevice(ctx, dev); err != nil {
+		return err
+	}
+
+	// Upload asset to CARTROM
+	size := int64(len(rpk.Asset))
+	progress(PhaseUpload, 0)
+	pc := &progressCounter{total: size, report: func(pct int) { progress(PhaseUpload, pct) }}
+	if err := dev.CmdUpload(ctx, io.TeeReader(bytes.NewReader(rpk.Asset), pc), size, BankCARTROM, 0); err != nil {
+		return err
+	}
+
+	// Download asset, compare CRC32, and verify that it's not corrupted
+	progress(PhaseReadback, 0)
+	crc := crc32.NewIEEE()
+	pc = &progressCounter{total: size, report: func(pct int) { progress(PhaseReadback, pct) }}
+	if err := dev.CmdDownload(ctx, io.MultiWriter(crc, pc), size, BankCARTROM, 0); err != nil {
+		return err
+	}
+	if crc.Sum32() != crc32.ChecksumIEEE(rpk.Asset) {
+		return fmt.Errorf("%w: firmware readback does not match -- 64drive SDRAM failure? (check with \"g64drive memtest\")", ErrIntegrity)
+	}
+
+	rctx, cancel := context.WithTimeout(ctx, upgradeReportTimeout)
+	stat, err := dev.CmdUpgradeReport(rctx)
+	cancel()
+	if err != nil {
+		return err
+	} else if stat != UpgradeReady {
+		return fmt.Errorf("upgrade module is not ready (%v) -- try power-cycling your 64drive unit", stat)
+	}
+
+	if cb.Confirm != nil && !cb.Confirm() {
+		return ErrUpgradeAborted
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := dev.CmdUpgradeStart(ctx); err != nil {
+		return err
+	}
+
+	// Monitor the upgrade until it finishes
+	cur, changed := UpgradeReady, time.Now()
+	for !cur.IsFinished() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(upgradePollInterval):
+		}
+
+		rctx, cancel := context.WithTimeout(ctx, upgradeReportTimeout)
+		stat, err := dev.CmdUpgradeReport(rctx)
+		cancel()
+		if err == nil && stat != cur {
+			cur, changed = stat, time.Now()
+			if ev, found := upgradeProgress[stat]; found {
+				progress(ev.Phase, ev.Percent)
+			}
+		} else if time.Since(changed) > upgradeStallTimeout {
+			if err != nil {
+				return fmt.Errorf("%w (%v)", ErrUpgradeStuck, err)
+			}
+			return ErrUpgradeStuck
+		}
+	}
+
+	if cur != UpgradeSuccess {
+		return &UpgradeError{Status: cur}
+	}
+	return nil
+}
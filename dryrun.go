@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/rasky/g64drive/drive64"
+)
+
+// flagDryRun is set by --dry-run, on the commands that change the 64drive configuration
+var flagDryRun bool
+
+// Help of --dry-run, shared by all the commands that have it
+const dryRunUsage = "print the commands that would be sent to 64drive, without changing its configuration " +
+	"(the 64drive is still opened, and read-only commands are executed to resolve autodetection)"
+
+// dryRunOpenError explains why a 64drive used by another process cannot be
+// opened in dry-run mode either.
+func dryRunOpenError(err error) error {
+	if flagDryRun && errors.Is(err, drive64.ErrDeviceBusy) {
+		return fmt.Errorf("%w -- --dry-run still reads from the 64drive: run the command within the \"g64drive shell\" using it, or serve the 64drive with \"g64drive daemon\"", err)
+	}
+	return err
+}
+
+// dryRunDevice wraps dev in dry-run mode if --dry-run was specified, so that
+// the commands that would be sent are printed instead of executed.
+func dryRunDevice(dev *drive64.Device) *drive64.Device {
+	if !flagDryRun {
+		return dev
+	}
+	return dev.DryRun(printDryRunCmd)
+}
+
+// printDryRunCmd shows a command sent in dry-run mode, and the range of memory
+// accessed by transfers.
+func printDryRunCmd(c drive64.DryRunCmd) {
+	if jsonOutput() {
+		res := jsonDryRunCmd{Cmd: uint8(c.Cmd), Name: c.Cmd.String(), Args: c.Args, InSize: len(c.In), OutSize: c.OutSize, Executed: c.Executed}
+		if bank, offset, size, ok := c.Bank(); ok {
+			res.Bank, res.Offset, res.Size = bank.Info().Name, offset, size
+		}
+		emit("dry_run", res)
+		return
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "[dry-run] %v", cmdName(c.Cmd))
+	if len(c.Args) > 0 {
+		var hexargs []string
+		for _, a := range c.Args {
+			hexargs = append(hexargs, fmt.Sprintf("%08x", a))
+		}
+		fmt.Fprintf(&sb, " args=[%v]", strings.Join(hexargs, " "))
+	}
+	if bank, offset, size, ok := c.Bank(); ok {
+		what := "payload"
+		if c.Cmd == drive64.CmdDumpToPc {
+			what = "response"
+		}
+		fmt.Fprintf(&sb, " %v=%v:0x%x-0x%x", what, bank.Info().Name, offset, offset+uint32(size)-1)
+	} else {
+		if len(c.In) > 0 {
+			fmt.Fprintf(&sb, " payload=%d bytes", len(c.In))
+		}
+		if c.OutSize > 0 {
+			fmt.Fprintf(&sb, " response=%d bytes", c.OutSize)
+		}
+	}
+	if c.Executed {
+		sb.WriteString(" (read-only, executed)")
+	}
+	fmt.Println(sb.String())
+}
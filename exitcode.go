@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/rasky/g64drive/drive64"
+)
+
+// exitCodes maps the errors reported by drive64 to the exit codes of the process,
+// so that scripts can tell the different failures apart. Any other error exits
+// with code 1. The codes are part of the public interface: don't renumber them.
+var exitCodes = []struct {
+	err  error
+	code int
+	desc string
+}{
+	{errUsage, 2, "invalid command line arguments"},
+	{drive64.ErrNoDevices, 3, "no 64drive found"},
+	{drive64.ErrUnknownDevice, 3, ""},
+	{drive64.ErrMultipleDevices, 4, "multiple 64drive found (select one with --serial)"},
+	{drive64.ErrDeviceBusy, 5, "64drive busy (used by another process)"},
+	{drive64.ErrUnsupported, 6, "operation not supported by the 64drive hardware or firmware"},
+	{drive64.ErrWrongDevice, 6, ""},
+	{drive64.ErrFrozen, 7, "64drive not responding"},
+	{drive64.ErrProtocol, 8, "USB protocol error"},
+	{drive64.ErrIntegrity, 9, "transfer integrity check failed"},
+	{drive64.ErrUpgradeAborted, 10, "operation not confirmed by the user"},
+	{errNotConfirmed, 10, ""},
+	{drive64.ErrAborted, 130, "aborted with CTRL+C"},
+	{context.Canceled, 130, ""},
+}
+
+// errUsage is wrapped by the errors caused by invalid command line arguments
+var errUsage = errors.New("invalid command line arguments")
+
+// errNotConfirmed is returned when the user declines a destructive operation
+var errNotConfirmed = errors.New("operation not confirmed by the user")
+
+// usageError is an error in the command line arguments (see usageErrorf)
+type usageError struct {
+	msg string
+}
+
+func (e *usageError) Error() string { return e.msg }
+func (e *usageError) Unwrap() error { return errUsage }
+
+// usageErrorf returns an error wrapping errUsage, with the specified message
+func usageErrorf(format string, args ...interface{}) error {
+	return &usageError{fmt.Sprintf(format, args...)}
+}
+
+// exitCode returns the exit code for the error returned by a command
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	for _, ec := range exitCodes {
+		if errors.Is(err, ec.err) {
+			return ec.code
+		}
+	}
+	return 1
+}
+
+// exitCodesHelp documents the exit codes, for the help of the root command
+func exitCodesHelp() string {
+	var sb strings.Builder
+	sb.WriteString("Exit codes:\n")
+	sb.WriteString("    0  success\n")
+	sb.WriteString("    1  generic error\n")
+	for _, ec := range exitCodes {
+		if ec.desc != "" {
+			fmt.Fprintf(&sb, "  %3d  %s\n", ec.code, ec.desc)
+		}
+	}
+	return sb.String()
+}
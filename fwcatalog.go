@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/rasky/g64drive/drive64"
+	"github.com/spf13/cobra"
+)
+
+var flagFwFrom string
+
+// fwCatalogEntry is a RPK archive found in a firmware directory
+type fwCatalogEntry struct {
+	Path string
+	RPK  *drive64.RPK
+}
+
+func (e *fwCatalogEntry) Version() drive64.Version {
+	return drive64.Version(e.RPK.Metadata.ContentVersion)
+}
+
+// loadFwCatalog loads all the RPK archives found in dir, sorted by magic,
+// variant, type and version (newest first). Files that cannot be parsed are
+// skipped, and reported in verbose mode.
+func loadFwCatalog(dir string) ([]fwCatalogEntry, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var cat []fwCatalogEntry
+	for _, fi := range files {
+		if fi.IsDir() || !strings.EqualFold(filepath.Ext(fi.Name()), ".rpk") {
+			continue
+		}
+		path := filepath.Join(dir, fi.Name())
+		rpk, err := loadRPK(path)
+		if err != nil {
+			vprintf("skipping %v: %v\n", path, err)
+			continue
+		}
+		cat = append(cat, fwCatalogEntry{path, rpk})
+	}
+
+	sort.SliceStable(cat, func(i, j int) bool {
+		mi, mj := &cat[i].RPK.Metadata, &cat[j].RPK.Metadata
+		if mi.Magic != mj.Magic {
+			return mi.Magic < mj.Magic
+		}
+		if mi.Variant != mj.Variant {
+			return mi.Variant < mj.Variant
+		}
+		if mi.Type != mj.Type {
+			return mi.Type > mj.Type
+		}
+		if mi.ContentVersion != mj.ContentVersion {
+			return mi.ContentVersion > mj.ContentVersion
+		}
+		return mi.Date > mj.Date
+	})
+	return cat, nil
+}
+
+// compatibleFirmwares returns the firmwares of the catalog that are compatible
+// with the specified device, newest first.
+func compatibleFirmwares(cat []fwCatalogEntry, hwvar drive64.Variant, magic [4]byte) []fwCatalogEntry {
+	var fws []fwCatalogEntry
+	for _, e := range cat {
+		if e.RPK.Metadata.Type == drive64.RPKAssetFirmware && e.RPK.CheckCompatible(hwvar, magic) == nil {
+			fws = append(fws, e)
+		}
+	}
+	return fws
+}
+
+// printChangelog shows the changes of all firmwares newer than from, up to (and including) to.
+func printChangelog(fws []fwCatalogEntry, from, to drive64.Version) {
+	// fws is sorted newest first, show the changes in chronological order
+	var last drive64.Version
+	for i := len(fws) - 1; i >= 0; i-- {
+		e := &fws[i]
+		v := e.Version()
+		if v <= from || v > to || v == last {
+			continue
+		}
+		last = v
+		printf("\n== Firmware %v (%v) ==\n", v, e.RPK.Metadata.Date)
+		if note := e.RPK.Metadata.ContentNote; note != "" {
+			printf("%v\n", note)
+		}
+		if changes := e.RPK.Metadata.ContentChanges; changes != "" {
+			printf("%v\n", changes)
+		}
+	}
+	printf("\n")
+}
+
+// selectFirmware picks the newest firmware in dir compatible with the device, and
+// shows the changelog from the installed version. It returns nil if the device is
+// already up to date.
+func selectFirmware(ctx context.Context, dev *drive64.Device, dir string) (*drive64.RPK, error) {
+	cat, err := loadFwCatalog(dir)
+	if err != nil {
+		return nil, err
+	}
+	hwvar, fwver, magic, err := dev.CmdVersionRequest(ctx)
+	if err != nil {
+		return nil, err
+	}
+	fws := compatibleFirmwares(cat, hwvar, magic)
+	if len(fws) == 0 {
+		return nil, fmt.Errorf("no firmware for 64drive %v found in %v", hwvar, dir)
+	}
+
+	best := &fws[0]
+	vprintf("Newest firmware: %v (%v)\n", best.Version(), best.Path)
+	if best.Version() <= fwver {
+		printf("64drive is up to date (firmware %v)\n", fwver)
+		return nil, nil
+	}
+	printChangelog(fws, fwver, best.Version())
+	return best.RPK, nil
+}
+
+func cmdFirmwareList(cmd *cobra.Command, args []string) error {
+	cat, err := loadFwCatalog(args[0])
+	if err != nil {
+		return err
+	}
+	if len(cat) == 0 {
+		return fmt.Errorf("no firmware archives found in %v", args[0])
+	}
+
+	printf("%-6s %-8s %-11s %-8s %-11s %s\n", "Magic", "Variant", "Type", "Version", "Date", "File")
+	for _, e := range cat {
+		m := &e.RPK.Metadata
+		emit("firmware", jsonFirmware{File: e.Path, Metadata: m})
+		printf("%-6s %-8s %-11s %-8s %-11s %s\n", m.Magic, m.Variant, m.Type, e.Version(), m.Date, filepath.Base(e.Path))
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rasky/g64drive/drive64"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v2"
+)
+
+// fwPackMetadata is the YAML description of a RPK archive, used by "firmware pack".
+type fwPackMetadata struct {
+	Format            uint32 `yaml:"format"`
+	Copyright         string `yaml:"copyright"`
+	Date              string `yaml:"date"`
+	File              string `yaml:"file"`
+	Type              string `yaml:"type"`
+	Product           string `yaml:"product"`
+	ProductText       string `yaml:"product_text"`
+	Device            string `yaml:"device"`
+	Magic             string `yaml:"magic"`
+	Variant           string `yaml:"variant"`
+	Version           string `yaml:"version"`
+	VersionSpecial    uint8  `yaml:"version_special"`
+	PrerequisitesText string `yaml:"prerequisites"`
+	Note              string `yaml:"note"`
+	Changes           string `yaml:"changes"`
+	Errata            string `yaml:"errata"`
+	Extra             string `yaml:"extra"`
+}
+
+// Example of metadata file, shown in the help of "firmware pack"
+const fwPackExample = `format: 1
+copyright: (c) 2018 Retroactive LLC
+date: 2018-01-04
+type: firmware
+product: 64drive
+product_text: 64drive
+device: EP4CE10F17
+magic: UDEV
+variant: B
+version: "2.05"
+note: Adds support for USB communication from N64.
+changes: |
+  1. Block-based USB communication pipe is now implemented`
+
+func newRPKFromYAML(data []byte, asset []byte, assetName string) (*drive64.RPK, error) {
+	var meta fwPackMetadata
+	if err := yaml.UnmarshalStrict(data, &meta); err != nil {
+		return nil, err
+	}
+
+	rpk := &drive64.RPK{Asset: asset}
+	m := &rpk.Metadata
+	switch strings.ToLower(meta.Type) {
+	case "firmware":
+		m.Type = drive64.RPKAssetFirmware
+	case "bootloader":
+		m.Type = drive64.RPKAssetBootloader
+	default:
+		return nil, fmt.Errorf("invalid type %q (must be firmware or bootloader)", meta.Type)
+	}
+	vers, err := drive64.NewVersionFromString(meta.Version)
+	if err != nil {
+		return nil, err
+	}
+	if meta.File == "" {
+		meta.File = assetName
+	}
+	if meta.ProductText == "" {
+		meta.ProductText = meta.Product
+	}
+
+	m.Format = meta.Format
+	m.Copyright = meta.Copyright
+	m.Date = meta.Date
+	m.File = meta.File
+	m.TypeText = m.Type.String()
+	m.Product = meta.Product
+	m.ProductText = meta.ProductText
+	m.Device = meta.Device
+	m.Magic = meta.Magic
+	m.Variant = meta.Variant
+	m.ContentVersion = uint16(vers)
+	m.ContentVersionSpecial = meta.VersionSpecial
+	m.ContentVersionText = vers.String()
+	m.PrerequisitesText = meta.PrerequisitesText
+	m.ContentNote = strings.TrimSpace(meta.Note)
+	m.ContentChanges = strings.TrimSpace(meta.Changes)
+	m.ContentErrata = strings.TrimSpace(meta.Errata)
+	m.ContentExtra = strings.TrimSpace(meta.Extra)
+	return rpk, nil
+}
+
+func cmdFirmwarePack(cmd *cobra.Command, args []string) error {
+	asset, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+	metadata, err := ioutil.ReadFile(args[1])
+	if err != nil {
+		return err
+	}
+	rpk, err := newRPKFromYAML(metadata, asset, filepath.Base(args[0]))
+	if err != nil {
+		return fmt.Errorf("%v: %v", args[1], err)
+	}
+
+	f, err := os.Create(args[2])
+	if err != nil {
+		return err
+	}
+	if _, err := rpk.WriteTo(f); err != nil {
+		f.Close()
+		os.Remove(args[2])
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	vprintf("Created %v (%v %v, %d bytes of asset)\n", args[2], rpk.Metadata.TypeText, rpk.Metadata.ContentVersionText, len(asset))
+	emit("firmware", jsonFirmware{File: args[2], Metadata: &rpk.Metadata})
+	return nil
+}
+
+func cmdFirmwareValidate(cmd *cobra.Command, args []string) error {
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	errs := drive64.ValidateRPK(f)
+	res := jsonValidation{File: args[0], Problems: []string{}}
+	for _, err := range errs {
+		res.Problems = append(res.Problems, err.Error())
+	}
+	emit("validation", res)
+	if len(errs) == 0 {
+		printf("%v: OK\n", args[0])
+		return nil
+	}
+	for _, err := range errs {
+		printf("%v: %v\n", args[0], err)
+	}
+	return fmt.Errorf("%v: %d problem(s) found", args[0], len(errs))
+}
@@ -4,13 +4,12 @@ import (
 	"bytes"
 	"context"
 	"crypto/md5"
-	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
-	"hash/crc32"
 	"io"
 	"io/ioutil"
+	"math"
 	"os"
 	"os/signal"
 	"path/filepath"
@@ -28,21 +27,28 @@ import (
 )
 
 var (
-	flagVerbose      bool
-	flagOffset       sizeUnit
-	flagSize         sizeUnit
-	flagAutoCic      bool
-	flagAutoSave     bool
-	flagAutoExtended bool
-	flagBank         string
-	flagQuiet        bool
-	flagByteswapD    int
-	flagByteswapU    int
-	flagFwExtractOut string
+	flagVerbose        bool
+	flagOffset         sizeUnit
+	flagSize           sizeUnit
+	flagAutoCic        bool
+	flagAutoSave       bool
+	flagAutoExtended   bool
+	flagBank           string
+	flagQuiet          bool
+	flagByteswapD      int
+	flagByteswapU      int
+	flagFwExtractOut   string
+	flagWait           bool
+	flagWaitTimeout    time.Duration
+	flagReconnect      bool
+	flagAllowDowngrade bool
+	flagUpgradeYes     bool
+	flagSerial         string
 
 	pflagAutoCic      *pflag.Flag
 	pflagAutoSave     *pflag.Flag
 	pflagAutoExtended *pflag.Flag
+	pflagByteswapD    *pflag.Flag
 )
 
 type sizeUnit struct {
@@ -82,22 +88,22 @@ func vprintf(s string, args ...interface{}) {
 }
 
 func flagBankParse() (drive64.Bank, error) {
-	switch flagBank {
-	case "rom":
-		return drive64.BankCARTROM, nil
-	case "sram256":
-		return drive64.BankSRAM256, nil
-	case "sram768":
-		return drive64.BankSRAM768, nil
-	case "flash":
-		return drive64.BankFLASH, nil
-	case "flash_pokstad2":
-		return drive64.BankFLASH_POKSTAD2, nil
-	case "eeprom":
-		return drive64.BankEEPROM, nil
-	default:
-		return drive64.BankCARTROM, fmt.Errorf("invalid bank: %v", flagBank)
+	bank, err := drive64.NewBankFromString(flagBank)
+	if err != nil {
+		return 0, usageErrorf("%v", err)
+	}
+	return bank, nil
+}
+
+// flagOffsetParse returns the transfer offset specified with --offset, which
+// can also be a N64 PI address (eg: 0x10001000). In that case, the address is
+// translated to the bank it is mapped to.
+func flagOffsetParse(bank drive64.Bank) (drive64.Bank, uint32, error) {
+	if flagOffset.size < 0 || flagOffset.size > math.MaxUint32 {
+		return bank, 0, usageErrorf("invalid offset value")
 	}
+	bank, offset := drive64.TranslatePIAddress(uint32(flagOffset.size), bank)
+	return bank, offset, nil
 }
 
 // safeSigIntContext executes function f with a context which is canceled when CTRL+C is called.
@@ -122,37 +128,130 @@ func safeSigIntContext(f func(ctx context.Context) error) error {
 	}()
 
 	err := f(ctx)
-	if err == context.Canceled {
-		err = errors.New("SIGINT caught, exiting")
+	if errors.Is(err, context.Canceled) {
+		err = fmt.Errorf("%w (SIGINT caught)", drive64.ErrAborted)
 	}
 	return err
 }
 
+// cmdTimeout is the maximum time that a single 64drive command (not a bulk
+// transfer) can take before the device is considered frozen.
+const cmdTimeout = 5 * time.Second
+
+// cmdContext returns a context to be used for single 64drive commands,
+// which expires after cmdTimeout.
+func cmdContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), cmdTimeout)
+}
+
+// openDevice opens the single 64drive attached to this computer, or the one
+// selected with --serial. If --wait was specified, it blocks until the device
+// is attached. Within "g64drive shell", the device opened by the shell is returned.
+// The link profile saved by "g64drive bench" (if any) is applied to the device.
+// With --dry-run, the device is opened in dry-run mode (see dryRunDevice): it is
+// still opened (and locked) as usual, as read-only commands are executed.
+func openDevice() (*drive64.Device, error) {
+	if shellDevice != nil {
+		return dryRunDevice(shellDevice.Retain()), nil
+	}
+
+	var dev *drive64.Device
+	var err error
+	switch {
+	case !flagWait && flagSerial == "":
+		dev, err = drive64.NewDeviceSingle()
+	case !flagWait:
+		dev, err = drive64.NewDeviceBySerial(flagSerial)
+	default:
+		err = safeSigIntContext(func(ctx context.Context) error {
+			var err error
+			dev, err = waitDevice(ctx, flagSerial)
+			return err
+		})
+		return dev, dryRunOpenError(err)
+	}
+	if err != nil {
+		return nil, dryRunOpenError(err)
+	}
+	applyLinkProfile(dev)
+	return dryRunDevice(dev), nil
+}
+
+// waitDevice blocks until the 64drive with the specified serial (or the single
+// 64drive, if serial is empty) is attached, and opens it like openDevice.
+func waitDevice(ctx context.Context, serial string) (*drive64.Device, error) {
+	var dev *drive64.Device
+	var err error
+	if serial == "" {
+		dev, err = drive64.WaitDeviceSingle(ctx)
+	} else {
+		dev, err = drive64.WaitDeviceBySerial(ctx, serial)
+	}
+	if err != nil {
+		return nil, err
+	}
+	applyLinkProfile(dev)
+	return dryRunDevice(dev), nil
+}
+
 func cmdList(cmd *cobra.Command, args []string) error {
-	devices, unk := drive64.Enumerate()
+	devices, unk, err := drive64.Enumerate()
+	if err != nil {
+		return err
+	}
 
 	if len(devices) == 0 {
 		if unk {
 			return drive64.ErrUnknownDevice
 		}
-		return errors.New("no 64drive devices found")
+		return drive64.ErrNoDevices
 	}
 
 	printf("Found %d 64drive device(s):\n", len(devices))
 	for i, d := range devices {
 		printf(" * %d: %v %v (serial: %v)\n", i, d.Manufacturer, d.Description, d.Serial)
-		if flagVerbose {
-			if dev, err := d.Open(); err == nil {
-				if hwver, fwver, _, err := dev.CmdVersionRequest(); err == nil {
-					printf("   -> Hardware: %v, Firmware: %v\n", hwver, fwver)
-				} else {
+		info := jsonDevice{Index: i, Manufacturer: d.Manufacturer, Description: d.Description, Serial: d.Serial}
+		// Versions are always included in the JSON output, as they are cheap to query
+		if flagVerbose || jsonOutput() {
+			// Within the shell, its device is already open (and locked)
+			var dev *drive64.Device
+			if shellDevice != nil && shellDevice.Description().Serial == d.Serial {
+				dev = shellDevice.Retain()
+			} else {
+				dev, err = d.Open()
+			}
+			if err == nil {
+				ctx, cancel := cmdContext()
+				hwver, fwver, magic, err := dev.CmdVersionRequest(ctx)
+				cancel()
+				if err != nil {
+					dev.Close()
 					return err
 				}
+				printf("   -> Hardware: %v, Firmware: %v\n", hwver, fwver)
+				info.Hardware, info.Firmware, info.Magic = hwver.String(), fwver.String(), string(magic[:])
+
+				caps := drive64.Capabilities{Variant: hwver, Firmware: fwver}
+				printf("   -> Max ROM size: %d MiB\n", caps.MaxROMSize()/(1024*1024))
+				var sts []string
+				for _, st := range caps.SaveTypes() {
+					sts = append(sts, st.String())
+				}
+				printf("   -> Save types: %v\n", strings.Join(sts, ", "))
+				for _, fi := range drive64.FeatureInfos {
+					if req := caps.Requirement(fi.Feature); req != "" {
+						printf("   -> %v: no (requires %v)\n", fi.Name, req)
+					} else {
+						printf("   -> %v: yes\n", fi.Name)
+					}
+				}
+				info.Capabilities = newJSONCapabilities(caps)
 				dev.Close()
 			} else {
 				return err
 			}
 		}
+		emit("device", info)
 	}
 
 	return nil
@@ -161,7 +260,8 @@ func cmdList(cmd *cobra.Command, args []string) error {
 func download(dev *drive64.Device, w io.Writer, size int64, bank drive64.Bank, offset uint32, pbdesc string) error {
 	var pbw io.Writer
 	pbw = os.Stdout
-	if flagQuiet {
+	if flagQuiet || dev.IsDryRun() {
+		// In dry-run mode, the progress bar would be mixed with the commands
 		pbw = ioutil.Discard
 	}
 	pb := progressbar.NewOptions64(int64(size),
@@ -169,7 +269,7 @@ func download(dev *drive64.Device, w io.Writer, size int64, bank drive64.Bank, o
 		progressbar.OptionSetWriter(pbw))
 
 	return safeSigIntContext(func(ctx context.Context) error {
-		defer fmt.Println()
+		defer printf("\n")
 		return dev.CmdDownload(ctx, io.MultiWriter(w, pb), size, bank, offset)
 	})
 }
@@ -177,7 +277,8 @@ func download(dev *drive64.Device, w io.Writer, size int64, bank drive64.Bank, o
 func upload(dev *drive64.Device, r io.Reader, size int64, bank drive64.Bank, offset uint32, pbdesc string) error {
 	var pbw io.Writer
 	pbw = os.Stdout
-	if flagQuiet {
+	if flagQuiet || dev.IsDryRun() {
+		// In dry-run mode, the progress bar would be mixed with the commands
 		pbw = ioutil.Discard
 	}
 	pb := progressbar.NewOptions64(size,
@@ -191,126 +292,180 @@ func upload(dev *drive64.Device, r io.Reader, size int64, bank drive64.Bank, off
 	}()
 
 	return safeSigIntContext(func(ctx context.Context) error {
-		defer fmt.Println()
+		defer printf("\n")
 		return dev.CmdUpload(ctx, pr, size, bank, offset)
 	})
 }
 
+// upgradeFirmware flashes the firmware contained in the RPK, asking for
+// confirmation unless --yes was specified.
 func upgradeFirmware(dev *drive64.Device, rpk *drive64.RPK) error {
-	if err := safeSigIntContext(func(ctx context.Context) error {
-		// Upload firmware asset to CARTROM
-		vprintf("Uploading firmware\n")
-		if err := dev.CmdUpload(ctx, bytes.NewReader(rpk.Asset), int64(len(rpk.Asset)), drive64.BankCARTROM, 0); err != nil {
-			return err
+	asset := strings.ToLower(rpk.Metadata.Type.String())
+	serial := dev.Description().Serial
+
+	confirm := func() bool {
+		ctx, cancel := cmdContext()
+		defer cancel()
+		_, swver, _, err := dev.CmdVersionRequest(ctx)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cannot read the firmware version: %v\n", err)
+			return false
 		}
 
-		// Download firmware asset, compare CRC32, and verify that it's not corrupted
-		vprintf("Verifying firmware\n")
-		crc := crc32.NewIEEE()
-		if err := dev.CmdDownload(ctx, crc, int64(len(rpk.Asset)), drive64.BankCARTROM, 0); err != nil {
-			return err
+		if jsonOutput() {
+			// --yes is mandatory in JSON mode (see cmdFirmwareUpgrade)
+			emit("upgrade_plan", jsonUpgradePlan{
+				Serial:  serial,
+				Current: swver.String(),
+				Type:    asset,
+				Version: rpk.Metadata.ContentVersionText,
+				Date:    rpk.Metadata.Date,
+				Note:    rpk.Metadata.ContentNote,
+			})
+		} else {
+			fmt.Printf("Ready to upgrade 64drive (serial %v)\n", serial)
+			fmt.Printf("Current firmware: %v\n", swver)
+			fmt.Printf("New %v %v (%v) - %v\n", asset, rpk.Metadata.ContentVersionText, rpk.Metadata.Date, rpk.Metadata.ContentNote)
 		}
-		if crc.Sum32() != crc32.ChecksumIEEE(rpk.Asset) {
-			return errors.New("firmware transfer failed - 64drive SDRAM failure?")
+		if flagDryRun || flagUpgradeYes {
+			return true
 		}
+		var resp string
+		fmt.Printf("Do you want to proceed (Y/N):")
+		_, err = fmt.Scanln(&resp)
+		return err == nil && strings.ToLower(resp) == "y"
+	}
 
-		if stat, err := dev.CmdUpgradeReport(); err != nil {
-			return err
-		} else if stat != drive64.UpgradeReady {
-			return fmt.Errorf("upgrade module is not ready (%v) -- try power-cycling your 64drive unit", stat)
+	// Transfer phases are only logged, while flashing phases are shown
+	// on a progress bar (created after the confirmation).
+	const pbmax = 100
+	var pb *progressbar.ProgressBar
+	pbidx := 0
+	lastPhase := drive64.UpgradePhase(-1)
+	progress := func(ev drive64.UpgradeEvent) {
+		if jsonOutput() {
+			emit("upgrade_progress", jsonUpgradeProgress{Phase: ev.Phase.String(), Percent: ev.Percent})
+			return
+		}
+		if ev.Phase < drive64.PhaseVerify {
+			if ev.Phase != lastPhase {
+				vprintf("%v %v\n", ev.Phase, asset)
+				lastPhase = ev.Phase
+			}
+			return
+		}
+		if pb == nil {
+			pb = progressbar.NewOptions(pbmax, progressbar.OptionSetDescription("Upgrading"))
 		}
 
-		return nil
-
-	}); err != nil {
-		return err
+		// Verifying: 0-10%, erasing: 10-50%, flashing: 50-100%
+		var newidx int
+		switch ev.Phase {
+		case drive64.PhaseVerify:
+			newidx = ev.Percent / 10
+		case drive64.PhaseErase:
+			newidx = 10 + ev.Percent*40/100
+		case drive64.PhaseWrite:
+			newidx = 50 + ev.Percent*50/100
+		case drive64.PhaseDone:
+			newidx = pbmax
+		}
+		pb.Describe(ev.Phase.String())
+		if newidx > pbidx {
+			pb.Add(newidx - pbidx)
+			pbidx = newidx
+		}
 	}
 
-	_, swver, _, err := dev.CmdVersionRequest()
+	err := safeSigIntContext(func(ctx context.Context) error {
+		return drive64.UpgradeFirmware(ctx, dev, rpk, drive64.UpgradeCallbacks{
+			Progress: progress,
+			Confirm:  confirm,
+		})
+	})
+	if pb != nil {
+		pb.Finish()
+		fmt.Println()
+	}
 	if err != nil {
 		return err
 	}
-
-	fmt.Printf("Ready to upgrade 64drive (serial %v)\n", dev.Description().Serial)
-	fmt.Printf("Current firmware: %v\n", swver)
-	fmt.Printf("New firmware %v (%v) - %v\n", rpk.Metadata.ContentVersionText, rpk.Metadata.Date, rpk.Metadata.ContentNote)
-	fmt.Printf("Do you want to proceed (Y/N):")
-	var resp string
-	if _, err := fmt.Scanln(&resp); err != nil || strings.ToLower(resp) != "y" {
+	if flagDryRun {
+		printf("Dry run: %v not upgraded\n", asset)
+		emit("upgrade", jsonUpgrade{Serial: serial, Type: asset, Version: rpk.Metadata.ContentVersionText})
 		return nil
 	}
+	printf("%v upgraded correctly -- power-cycle your 64drive unit\n", rpk.Metadata.Type)
+	emit("upgrade", jsonUpgrade{Serial: serial, Type: asset, Version: rpk.Metadata.ContentVersionText, Upgraded: true})
+	return nil
+}
 
-	if err := dev.CmdUpgradeStart(); err != nil {
-		return err
-	}
-
-	pb := progressbar.NewOptions64(10, progressbar.OptionSetDescription("Upgrading"))
-	pbidx := 0
-	curstat := drive64.UpgradeReady
-	for !curstat.IsFinished() {
-		stat, err := dev.CmdUpgradeReport()
-		if err == nil && stat != curstat {
-			newidx := pbidx
-			var pbdesc string
-			switch stat {
-			case drive64.UpgradeVerifying:
-				newidx = 1
-				pbdesc = "Verifying"
-			case drive64.UpgradeErasing00:
-				newidx = 2
-				pbdesc = "Erasing"
-			case drive64.UpgradeErasing25:
-				newidx = 3
-				pbdesc = "Erasing"
-			case drive64.UpgradeErasing50:
-				newidx = 4
-				pbdesc = "Erasing"
-			case drive64.UpgradeErasing75:
-				newidx = 5
-				pbdesc = "Erasing"
-			case drive64.UpgradeWriting00:
-				newidx = 6
-				pbdesc = "Flashing"
-			case drive64.UpgradeWriting25:
-				newidx = 7
-				pbdesc = "Flashing"
-			case drive64.UpgradeWriting50:
-				newidx = 8
-				pbdesc = "Flashing"
-			case drive64.UpgradeWriting75:
-				newidx = 9
-				pbdesc = "Flashing"
-			case drive64.UpgradeSuccess:
-				newidx = 10
-				pbdesc = "Finished"
+// autoSaveType detects the save type of the ROM loaded in CARTROM, by searching
+// its MD5 in the ROM database or, for homebrew, parsing the ED64 ROM header.
+// It also returns the name of the game, if found in the database.
+func autoSaveType(ctx context.Context, dev *drive64.Device, rommd5 string) (drive64.SaveType, string) {
+	st := drive64.SaveNone
+	game := romdb_search(rommd5)
+	if game.Name != "" {
+		vprintf("Detected game: %v\n", game.Name)
+		switch game.SaveType {
+		case "Eeprom 4KB":
+			st = drive64.SaveEeprom4Kbit
+		case "Eeprom 16KB":
+			st = drive64.SaveEeprom16Kbit
+		case "Flash RAM":
+			st = drive64.SaveFlashRAM1Mbit
+			// Special case: for Pokemon Stadium 2, 64drive HW1
+			// needs a special save type. This happens because HW1 only
+			// has 64Mb of RDRAM, and the ROM is 64Mb. Normally, the 1Mbit
+			// is stolen at the end of the RDRAM/ROM but this specific game
+			// has non-blank data at the end. So the 64drive firmware can use
+			// a different (hardcoded) address where to put the save data,
+			// overriding a portion that is known to be blank. Since this
+			// address is hardcoded in the firmware, we cannot use it for
+			// anything but this specific game.
+			if strings.HasPrefix(game.Name, "Pokemon Stadium 2") {
+				if hwvar, _, _, err := dev.CmdVersionRequest(ctx); err == nil && hwvar == drive64.VarRevA {
+					st = drive64.SaveFlashRAM1Mbit_PokStad2
+				}
 			}
-			if newidx != pbidx {
-				pb.Describe(pbdesc)
-				pb.Add(newidx - pbidx)
-				pbidx = newidx
+		case "SRAM":
+			st = drive64.SaveSRAM256Kbit
+		}
+	} else {
+		// Download the header and see if it matches
+		var header bytes.Buffer
+		if err := dev.CmdDownload(ctx, &header, 512,
+			drive64.BankCARTROM, 0); err != nil {
+			vprintf("Error reading back ROM header: %v\n", err)
+		} else {
+			var buf = header.Bytes()
+			if buf[0x3C] == 'E' && buf[0x3D] == 'D' {
+				vprintf("ED64 ROM header detected\n")
+				var cfg uint8 = buf[0x3F]
+				switch cfg >> 4 {
+				case 0:
+					st = drive64.SaveNone
+				case 1:
+					st = drive64.SaveEeprom4Kbit
+				case 2:
+					st = drive64.SaveEeprom16Kbit
+				case 3:
+					st = drive64.SaveSRAM256Kbit
+				case 4:
+					st = drive64.SaveSRAM768Kbit
+				case 5:
+					st = drive64.SaveFlashRAM1Mbit
+				case 6:
+					warnf("the ROM requested a 1Mbit SRAM savetype, which is not supported by 64drive")
+					st = drive64.SaveNone
+				default:
+					vprintf("WARNING: invalid ED64 ROM confing header value: %02x\n", cfg)
+				}
 			}
-
-			curstat = stat
 		}
-
-		time.Sleep(100 * time.Millisecond)
-	}
-
-	pb.Finish()
-
-	switch curstat {
-	case drive64.UpgradeGeneralFail:
-		return errors.New("Upgrade failed: general failure")
-	case drive64.UpgradeBadVariant:
-		return errors.New("Upgrade failed: wrong hardware variant")
-	case drive64.UpgradeVerifyFail:
-		return errors.New("Upgrade failed: firmware verification failure")
-	case drive64.UpgradeSuccess:
-		printf("\nFirmware upgraded correctly -- power-cycle your 64drive unit\n")
-		return nil
-	default:
-		return fmt.Errorf("unexpected upgrade status: %v", curstat)
 	}
+	return st, game.Name
 }
 
 func cmdUpload(cmd *cobra.Command, args []string) error {
@@ -320,7 +475,7 @@ func cmdUpload(cmd *cobra.Command, args []string) error {
 	}
 	defer f.Close()
 
-	dev, err := drive64.NewDeviceSingle()
+	dev, err := openDevice()
 	if err != nil {
 		return err
 	}
@@ -344,16 +499,16 @@ func cmdUpload(cmd *cobra.Command, args []string) error {
 	} else if flagByteswapU == 0 || flagByteswapU == 2 || flagByteswapU == 4 {
 		bs = drive64.ByteSwapper(flagByteswapU)
 	} else {
-		return errors.New("invalid byteswap value")
+		return usageErrorf("invalid byteswap value")
 	}
 	vprintf("byteswap: %v\n", bs)
 
 	size := flagSize.size
 	if size < 0 {
-		return errors.New("invalid size value (negative number")
+		return usageErrorf("invalid size value (negative number)")
 	}
 	if size%512 != 0 {
-		return errors.New("invalid size value (must be multiple of 512)")
+		return usageErrorf("invalid size value (must be multiple of 512)")
 	}
 	if size == 0 {
 		fi, err := f.Stat()
@@ -364,9 +519,19 @@ func cmdUpload(cmd *cobra.Command, args []string) error {
 	}
 	vprintf("size: %v\n", size)
 
-	offset := uint32(flagOffset.size)
+	bank, offset, err := flagOffsetParse(bank)
+	if err != nil {
+		return err
+	}
 	vprintf("offset: %v\n", offset)
 
+	ctx, cancel := cmdContext()
+	defer cancel()
+	caps, err := dev.Capabilities(ctx)
+	if err != nil {
+		return err
+	}
+
 	// --autocic defaults to true when uploading a ROM to CARTROM at offset 0
 	if !pflagAutoCic.Changed && bank == drive64.BankCARTROM && offset == 0 {
 		flagAutoCic = true
@@ -378,123 +543,89 @@ func cmdUpload(cmd *cobra.Command, args []string) error {
 	// --extended defaults to true when uploading a ROM to CARTROM at offset 0, if the ROM is larger than 64MB
 	// Otherwise, the ROM would uploaded correctly but the data would be inaccessible.
 	if !pflagAutoExtended.Changed && bank == drive64.BankCARTROM && offset == 0 && size > 64*1024*1024 {
-		if hwvar, fwver, _, err := dev.CmdVersionRequest(); err == nil && hwvar == drive64.VarRevA {
-			// Return an appropriate error message for HW1, taking into account that the user doesn't
-			// probably know what extended mode is.
-			return errors.New("ROMs larger than 64 MiB not supported on 64drive HW1")
-		} else if fwver < 206 {
-			return errors.New("ROMs larger than 64 MiB not supported on 64drive firmware < 2.06")
+		if err := caps.Check(drive64.FeatureExtended); err != nil {
+			return err
 		}
 		flagAutoExtended = true
 	}
 
 	if flagAutoExtended {
 		vprintf("Set extended mode\n")
-		if hwvar, fwver, _, err := dev.CmdVersionRequest(); err == nil && hwvar == drive64.VarRevA {
-			return errors.New("extended mode not supported on 64drive HW1")
-		} else if fwver < 206 {
-			return errors.New("extended mode not supported on 64drive firmware < 2.06")
-		} else if err := dev.CmdSetExtended(true); err != nil {
+		if err := setExtended(ctx, dev, true); err != nil {
 			return err
 		}
 	}
 
+	// Make sure that the transfer fits within the bank (transfers are padded to 512 bytes)
+	if err := bank.Info().CheckRange(caps.Variant, offset, (size+511)&^511); err != nil {
+		return err
+	}
+	if bank == drive64.BankCARTROM && !flagAutoExtended && int64(offset)+size > bank.Info().Capacity(caps.Variant, false) {
+		warnf("the data beyond 64 MiB is not visible to the N64 without extended mode (--extended)")
+	}
+
 	vprintf("uploading\n")
 	rommd5 := md5.New()
 	if err := upload(dev, io.TeeReader(bs.NewReader(f), rommd5), size, bank, offset, filepath.Base(args[0])); err != nil {
 		return err
 	}
 
+	// The upload might have taken a while, so start a new timeout
+	ctx, cancel = cmdContext()
+	defer cancel()
+
+	res := jsonUpload{
+		File:     args[0],
+		Bank:     bank.Info().Name,
+		Offset:   offset,
+		Size:     size,
+		ByteSwap: int(bs),
+		MD5:      hex.EncodeToString(rommd5.Sum(nil)),
+		Extended: flagAutoExtended,
+	}
+
+	if bank == drive64.BankCARTROM {
+		if offset == 0 {
+			recordRomUpload(ctx, dev, filepath.Base(args[0]), hex.EncodeToString(rommd5.Sum(nil)), size)
+		} else {
+			recordRomPatch(ctx, dev)
+		}
+	}
+
 	if flagAutoCic {
-		cic, err := cicAutodetect(dev)
+		cic, err := cicAutodetect(ctx, dev)
 		if err != nil {
 			return err
 		}
 		vprintf("Autoset CIC type: %v\n", cic)
 
-		if err := dev.CmdSetCicType(cic); err != nil {
-			if err == drive64.ErrUnsupported {
+		if err := setCicType(ctx, dev, cic); err != nil {
+			if errors.Is(err, drive64.ErrUnsupported) {
 				vprintf("Setting CIC not supported on 64drive HW1, skipping\n")
 			} else {
 				return err
 			}
+		} else {
+			res.CIC = cic.String()
 		}
 	}
 
 	if flagAutoSave {
-		rommd5 := hex.EncodeToString(rommd5.Sum(nil))
-		st := drive64.SaveNone
-		game := romdb_search(rommd5)
-		if game.Name != "" {
-			vprintf("Detected game: %v\n", game.Name)
-			switch game.SaveType {
-			case "Eeprom 4KB":
-				st = drive64.SaveEeprom4Kbit
-			case "Eeprom 16KB":
-				st = drive64.SaveEeprom16Kbit
-			case "Flash RAM":
-				st = drive64.SaveFlashRAM1Mbit
-				// Special case: for Pokemon Stadium 2, 64drive HW1
-				// needs a special save type. This happens because HW1 only
-				// has 64Mb of RDRAM, and the ROM is 64Mb. Normally, the 1Mbit
-				// is stolen at the end of the RDRAM/ROM but this specific game
-				// has non-blank data at the end. So the 64drive firmware can use
-				// a different (hardcoded) address where to put the save data,
-				// overriding a portion that is known to be blank. Since this
-				// address is hardcoded in the firmware, we cannot use it for
-				// anything but this specific game.
-				if strings.HasPrefix(game.Name, "Pokemon Stadium 2") {
-					if hwvar, _, _, err := dev.CmdVersionRequest(); err == nil && hwvar == drive64.VarRevA {
-						st = drive64.SaveFlashRAM1Mbit_PokStad2
-					}
-				}
-			case "SRAM":
-				st = drive64.SaveSRAM256Kbit
-			}
-		} else {
-			// Download the header and see if it matches
-			var header bytes.Buffer
-			if err := dev.CmdDownload(context.Background(), &header, 512,
-				drive64.BankCARTROM, 0); err != nil {
-				vprintf("Error reading back ROM header: %v\n", err)
-			} else {
-				var buf = header.Bytes()
-				if buf[0x3C] == 'E' && buf[0x3D] == 'D' {
-					vprintf("ED64 ROM header detected\n")
-					var cfg uint8 = buf[0x3F]
-					switch cfg >> 4 {
-					case 0:
-						st = drive64.SaveNone
-					case 1:
-						st = drive64.SaveEeprom4Kbit
-					case 2:
-						st = drive64.SaveEeprom16Kbit
-					case 3:
-						st = drive64.SaveSRAM256Kbit
-					case 4:
-						st = drive64.SaveSRAM768Kbit
-					case 5:
-						st = drive64.SaveFlashRAM1Mbit
-					case 6:
-						fmt.Printf("WARNING: the ROM requested a 1Mbit SRAM savetype, which is not supported by 64drive\n")
-						st = drive64.SaveNone
-					default:
-						vprintf("WARNING: invalid ED64 ROM confing header value: %02x\n", cfg)
-					}
-				}
-			}
-		}
+		st, game := autoSaveType(ctx, dev, hex.EncodeToString(rommd5.Sum(nil)))
+		res.Game = game
 		vprintf("Autoset save type: %v\n", st)
-		if err := dev.CmdSetSaveType(st); err != nil {
+		if err := setSaveType(ctx, dev, st); err != nil {
 			return err
 		}
+		res.SaveType = st.String()
 	}
 
+	emit("upload", res)
 	return nil
 }
 
 func cmdDownload(cmd *cobra.Command, args []string) error {
-	dev, err := drive64.NewDeviceSingle()
+	dev, err := openDevice()
 	if err != nil {
 		return err
 	}
@@ -505,37 +636,67 @@ func cmdDownload(cmd *cobra.Command, args []string) error {
 	if err != nil {
 		return err
 	}
+	bank, offset, err := flagOffsetParse(bank)
+	if err != nil {
+		return err
+	}
+	bankinfo := bank.Info()
 	vprintf("download bank: %v\n", bank)
 
 	var bs drive64.ByteSwapper
-	if flagByteswapD == 0 || flagByteswapD == 2 || flagByteswapD == 4 {
+	if !pflagByteswapD.Changed {
+		bs = bankinfo.ByteSwap
+	} else if flagByteswapD == 0 || flagByteswapD == 2 || flagByteswapD == 4 {
 		bs = drive64.ByteSwapper(flagByteswapD)
 	} else {
-		return errors.New("invalid byteswap value")
+		return usageErrorf("invalid byteswap value")
 	}
 	vprintf("byteswap: %v\n", bs)
 
-	f, err := os.Create(args[0])
+	ctx, cancel := cmdContext()
+	defer cancel()
+	hwvar, _, _, err := dev.CmdVersionRequest(ctx)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
 
+	// Extended mode doesn't affect USB transfers (see BankInfo.CheckRange)
 	size := flagSize.size
 	if size < 0 {
-		return errors.New("invalid size value (negative number")
+		return usageErrorf("invalid size value (negative number)")
+	}
+	if size == 0 {
+		if !bankinfo.Fixed {
+			return usageErrorf("--size is required to download from bank %v", bankinfo.Name)
+		}
+		if err := bankinfo.CheckRange(hwvar, offset, 0); err != nil {
+			return err
+		}
+		size = bankinfo.Capacity(hwvar, true) - int64(offset)
 	}
 	vprintf("size: %v\n", size)
-
-	var offset = uint32(flagOffset.size)
 	vprintf("offset: %v\n", offset)
 
-	return download(dev, bs.NewWriter(f), size, bank, offset, filepath.Base(args[0]))
+	if err := bankinfo.CheckRange(hwvar, offset, size); err != nil {
+		return err
+	}
+
+	f, err := os.Create(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := download(dev, bs.NewWriter(f), size, bank, offset, filepath.Base(args[0])); err != nil {
+		return err
+	}
+	emit("download", jsonTransfer{File: args[0], Bank: bank.Info().Name, Offset: offset, Size: size, ByteSwap: int(bs)})
+	return nil
 }
 
-func cicAutodetect(dev *drive64.Device) (drive64.CIC, error) {
+func cicAutodetect(ctx context.Context, dev *drive64.Device) (drive64.CIC, error) {
 	var header bytes.Buffer
-	if err := dev.CmdDownload(context.Background(), &header, 0x1000,
+	if err := dev.CmdDownload(ctx, &header, 0x1000,
 		drive64.BankCARTROM, 0); err != nil {
 		return 0, err
 	}
@@ -547,19 +708,22 @@ func cmdCic(cmd *cobra.Command, args []string) error {
 	if args[0] != "auto" {
 		var err error
 		if cic, err = drive64.NewCICFromString(args[0]); err != nil {
-			return err
+			return usageErrorf("%v", err)
 		}
 	}
 
-	dev, err := drive64.NewDeviceSingle()
+	dev, err := openDevice()
 	if err != nil {
 		return err
 	}
 	defer dev.Close()
 
+	ctx, cancel := cmdContext()
+	defer cancel()
+
 	if args[0] == "auto" {
 		var err error
-		if cic, err = cicAutodetect(dev); err != nil {
+		if cic, err = cicAutodetect(ctx, dev); err != nil {
 			return err
 		}
 	}
@@ -567,17 +731,21 @@ func cmdCic(cmd *cobra.Command, args []string) error {
 	vprintf("64drive serial: %v\n", dev.Description().Serial)
 	vprintf("CIC type: %v\n", cic)
 
-	return dev.CmdSetCicType(cic)
+	if err := setCicType(ctx, dev, cic); err != nil {
+		return err
+	}
+	emit("config", jsonConfig{CIC: cic.String()})
+	return nil
 }
 
 func cmdSaveType(cmd *cobra.Command, args []string) error {
 	var savetype drive64.SaveType
 	var err error
 	if savetype, err = drive64.NewSaveTypeFromString(args[0]); err != nil {
-		return err
+		return usageErrorf("%v", err)
 	}
 
-	dev, err := drive64.NewDeviceSingle()
+	dev, err := openDevice()
 	if err != nil {
 		return err
 	}
@@ -586,54 +754,62 @@ func cmdSaveType(cmd *cobra.Command, args []string) error {
 	vprintf("64drive serial: %v\n", dev.Description().Serial)
 	vprintf("Save type: %v\n", savetype)
 
-	return dev.CmdSetSaveType(savetype)
-
+	ctx, cancel := cmdContext()
+	defer cancel()
+	if err := setSaveType(ctx, dev, savetype); err != nil {
+		return err
+	}
+	emit("config", jsonConfig{SaveType: savetype.String()})
+	return nil
 }
 
 func cmdExtended(cmd *cobra.Command, args []string) error {
-	dev, err := drive64.NewDeviceSingle()
+	dev, err := openDevice()
 	if err != nil {
 		return err
 	}
 	defer dev.Close()
 
-	var extended bool
-	switch args[0] {
-	case "t", "true", "1":
-		extended = true
+	extended, err := strconv.ParseBool(args[0])
+	if err != nil {
+		return usageErrorf("invalid extended mode %q (must be true or false)", args[0])
 	}
 
 	vprintf("64drive serial: %v\n", dev.Description().Serial)
 	vprintf("Extended mode: %v\n", extended)
 
-	if hwvar, fwver, _, err := dev.CmdVersionRequest(); err == nil && hwvar == drive64.VarRevA {
-		return errors.New("extended mode not supported on 64drive HW1")
-	} else if fwver < 206 {
-		return errors.New("extended mode not supported on 64drive firmware < 2.06")
-	} else {
-		return dev.CmdSetExtended(extended)
+	ctx, cancel := cmdContext()
+	defer cancel()
+	if err := setExtended(ctx, dev, extended); err != nil {
+		return err
 	}
+	emit("config", jsonConfig{Extended: &extended})
+	return nil
 }
 
-func fwCmd(filename string, cb func(rpk *drive64.RPK) error) error {
+func loadRPK(filename string) (*drive64.RPK, error) {
 	f, err := os.Open(filename)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer f.Close()
+	return drive64.NewRPKFromReader(f)
+}
 
-	rpk, err := drive64.NewRPKFromReader(f)
+func fwCmd(filename string, cb func(rpk *drive64.RPK) error) error {
+	rpk, err := loadRPK(filename)
 	if err != nil {
 		return err
 	}
-
 	return cb(rpk)
 }
 
 func cmdFirmwareInfo(cmd *cobra.Command, args []string) error {
 	return fwCmd(args[0], func(rpk *drive64.RPK) error {
-		if !flagQuiet {
-			rpk.DumpMetadata()
+		if jsonOutput() {
+			emit("firmware", jsonFirmware{File: args[0], Metadata: &rpk.Metadata})
+		} else if !flagQuiet {
+			return rpk.DumpMetadata(os.Stdout, drive64.MetadataText)
 		}
 		return nil
 	})
@@ -648,63 +824,217 @@ func cmdFirmwareExtract(cmd *cobra.Command, args []string) error {
 		if err := ioutil.WriteFile(fn, rpk.Asset, 0666); err != nil {
 			return err
 		}
-		printf("Written %q (%d bytes)", fn, len(rpk.Asset))
+		printf("Written %q (%d bytes)\n", fn, len(rpk.Asset))
+		emit("extract", jsonExtract{File: fn, Size: len(rpk.Asset)})
 		return nil
 	})
 }
 
 func cmdFirmwareUpgrade(cmd *cobra.Command, args []string) error {
-	return fwCmd(args[0], func(rpk *drive64.RPK) error {
+	if (len(args) == 1) == (flagFwFrom != "") {
+		return usageErrorf("specify either a firmware file or a firmware directory with --from")
+	}
+	if jsonOutput() && !flagUpgradeYes && !flagDryRun {
+		return usageErrorf("--yes is required with --output json, as the upgrade cannot be confirmed interactively")
+	}
+
+	var rpk *drive64.RPK
+	if len(args) == 1 {
+		var err error
+		if rpk, err = loadRPK(args[0]); err != nil {
+			return err
+		}
 		switch rpk.Metadata.Type {
-		case 2: // Firmware
-		case 1:
-			return errors.New("bootloader upgrade not yet implemented")
+		case drive64.RPKAssetFirmware:
+		case drive64.RPKAssetBootloader:
+			return drive64.ErrBootloaderUpgrade
 		default:
 			return errors.New("unknown firmware type")
 		}
+	}
 
-		dev, err := drive64.NewDeviceSingle()
-		if err != nil {
+	dev, err := openDevice()
+	if err != nil {
+		return err
+	}
+	defer dev.Close()
+	vprintf("64drive serial: %v\n", dev.Description().Serial)
+
+	ctx, cancel := cmdContext()
+	defer cancel()
+	if rpk == nil {
+		if rpk, err = selectFirmware(ctx, dev, flagFwFrom); err != nil {
 			return err
+		} else if rpk == nil {
+			emit("upgrade", jsonUpgrade{Serial: dev.Description().Serial})
+			return nil
 		}
-		defer dev.Close()
-		vprintf("64drive serial: %v\n", dev.Description().Serial)
+	}
+	if err := rpk.CheckDevice(ctx, dev); err != nil {
+		return err
+	}
 
-		if hwvar, _, magic, err := dev.CmdVersionRequest(); err != nil {
-			return err
+	if err := checkUpgradeVersion(ctx, dev, rpk); err != nil {
+		return err
+	}
+	return upgradeFirmware(dev, rpk)
+}
+
+// checkUpgradeVersion verifies that the current firmware satisfies the prerequisites
+// of the RPK, and warns about downgrades. It also shows which features are enabled
+// or removed by the new version.
+func checkUpgradeVersion(ctx context.Context, dev *drive64.Device, rpk *drive64.RPK) error {
+	caps, err := dev.Capabilities(ctx)
+	if err != nil {
+		return err
+	}
+	cur := caps.Firmware
+	req, err := rpk.RequiredVersion()
+	if err != nil {
+		return err
+	}
+	if cur < req {
+		return fmt.Errorf("%w: this %v requires firmware %v or later (installed: %v) -- upgrade to an intermediate firmware first",
+			drive64.ErrUnsupported, strings.ToLower(rpk.Metadata.Type.String()), req, cur)
+	}
+
+	next := drive64.Version(rpk.Metadata.ContentVersion)
+	if next <= cur {
+		what := "DOWNGRADE"
+		if next == cur {
+			what = "REFLASH of the same version"
+		}
+		warnf("this is a %v (installed: %v, new: %v)", what, cur, next)
+		if !flagAllowDowngrade {
+			return errors.New("refusing to downgrade or reflash the firmware without --allow-downgrade")
+		}
+	}
+
+	nextCaps := drive64.Capabilities{Variant: caps.Variant, Firmware: next}
+	for _, f := range drive64.FeatureInfos {
+		switch {
+		case !caps.Supports(f.Feature) && nextCaps.Supports(f.Feature):
+			printf("Firmware %v enables: %v\n", next, f.Name)
+		case caps.Supports(f.Feature) && !nextCaps.Supports(f.Feature):
+			warnf("firmware %v removes: %v", next, f.Name)
+		}
+	}
+	return nil
+}
+
+func cmdWait(cmd *cobra.Command, args []string) error {
+	var dev *drive64.Device
+	err := safeSigIntContext(func(ctx context.Context) error {
+		if flagWaitTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, flagWaitTimeout)
+			defer cancel()
+		}
+		var err error
+		if flagSerial == "" {
+			dev, err = drive64.WaitDeviceSingle(ctx)
 		} else {
-			if !bytes.Equal(magic[:], []byte(rpk.Metadata.Magic)[:4]) {
-				return errors.New("firmware archive not meant for this device (different product)")
-			}
-			v := []byte(rpk.Metadata.Variant + "\000")[:2]
-			if hwvar != drive64.Variant(binary.BigEndian.Uint16(v)) {
-				return errors.New("firmware archive not meant for this device (different hardware variant)")
+			dev, err = drive64.WaitDeviceBySerial(ctx, flagSerial)
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			err = fmt.Errorf("no 64drive device attached after %v", flagWaitTimeout)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	defer dev.Close()
+
+	printf("Found 64drive (serial: %v)\n", dev.Description().Serial)
+	emit("device", jsonDevice{Serial: dev.Description().Serial})
+	return nil
+}
+
+func cmdResetLink(cmd *cobra.Command, args []string) error {
+	dev, err := openDevice()
+	if err != nil {
+		return err
+	}
+	defer dev.Close()
+	vprintf("64drive serial: %v\n", dev.Description().Serial)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 4*cmdTimeout)
+	defer cancel()
+	if err := dev.Recover(ctx); err != nil {
+		return fmt.Errorf("cannot recover 64drive USB link (%w) -- try power-cycling your 64drive unit", err)
+	}
+
+	hwver, fwver, _, err := dev.CmdVersionRequest(ctx)
+	if err != nil {
+		return err
+	}
+	printf("64drive USB link is working (Hardware: %v, Firmware: %v)\n", hwver, fwver)
+	emit("device", jsonDevice{Serial: dev.Description().Serial, Hardware: hwver.String(), Firmware: fwver.String()})
+	return nil
+}
+
+func cmdDaemon(cmd *cobra.Command, args []string) error {
+	devices, unk, err := drive64.Enumerate()
+	if err != nil {
+		return err
+	}
+	if len(devices) == 0 {
+		if unk {
+			return drive64.ErrUnknownDevice
+		}
+		return drive64.ErrNoDevices
+	}
+
+	return safeSigIntContext(func(ctx context.Context) error {
+		errs := make(chan error, len(devices))
+		for _, d := range devices {
+			dev, err := d.Open()
+			if err != nil {
+				return fmt.Errorf("cannot open 64drive (serial: %v): %w", d.Serial, err)
 			}
+			defer dev.Close()
+			applyLinkProfile(dev)
+
+			printf("Serving 64drive (serial: %v)\n", d.Serial)
+			go func() { errs <- dev.Serve(ctx) }()
 		}
 
-		switch rpk.Metadata.Type {
-		case drive64.RPKAssetFirmware:
-			return upgradeFirmware(dev, rpk)
-		case drive64.RPKAssetBootloader:
-			return errors.New("bootloader upgrade not implemented")
-		default:
-			return fmt.Errorf("unknown asset type: %s (%08x)", rpk.Metadata.TypeText, rpk.Metadata.Type)
+		// Serve returns nil when the context is canceled (CTRL+C)
+		for range devices {
+			if err := <-errs; err != nil {
+				return err
+			}
 		}
+		return nil
 	})
 }
 
+// checkDebugFifo verifies that the firmware of dev is new enough for "g64drive debug"
+func checkDebugFifo(dev *drive64.Device) error {
+	ctx, cancel := cmdContext()
+	defer cancel()
+	if caps, err := dev.Capabilities(ctx); err == nil {
+		if err := caps.Check(drive64.FeatureDebugFifo); err != nil {
+			return fmt.Errorf("%w\nDownload a newer firmware from http://64drive.retroactive.be, and then run \"g64drive firmware upgrade\" to upgrade", err)
+		}
+	}
+	return nil
+}
+
 func cmdDebug(cmd *cobra.Command, args []string) error {
-	dev, err := drive64.NewDeviceSingle()
+	dev, err := openDevice()
 	if err != nil {
 		return err
 	}
-	defer dev.Close()
-
-	// Check firmware version and verify if it's new enough
-	if _, fwver, _, err := dev.CmdVersionRequest(); err == nil {
-		if fwver < 205 {
-			return fmt.Errorf("\"g64drive debug\" requires 64drive firmware >= 2.05, found: %v\nDownload a newer firmware from http://64drive.retroactive.be, and then run \"g64drive firmware upgrade\" to upgrade", fwver)
+	defer func() {
+		if dev != nil {
+			dev.Close()
 		}
+	}()
+
+	if err := checkDebugFifo(dev); err != nil {
+		return err
 	}
 
 	return safeSigIntContext(func(ctx context.Context) error {
@@ -714,16 +1044,38 @@ func cmdDebug(cmd *cobra.Command, args []string) error {
 				// in progress, errors are not blocking and do not print
 				// header errors which is what we expect when we jump into the
 				// middle of the stream
-				if err != drive64.ErrInvalidFifoHead {
-					fmt.Fprintf(os.Stderr, "%v\n", err)
+				if errors.Is(err, drive64.ErrInvalidFifoHead) || ctx.Err() != nil {
+					continue
 				}
+				desc := dev.Description()
+				if flagReconnect && !desc.IsAttached() {
+					// The device was unplugged or power-cycled: wait for the
+					// same unit to come back and keep the session going.
+					fmt.Fprintf(os.Stderr, "64drive disconnected, waiting for it to be reattached...\n")
+					dev.Close()
+					if dev, err = waitDevice(ctx, desc.Serial); err != nil {
+						return err
+					}
+					fmt.Fprintf(os.Stderr, "64drive reconnected (serial: %v)\n", desc.Serial)
+
+					// The firmware might have been changed while disconnected
+					if err := checkDebugFifo(dev); err != nil {
+						return err
+					}
+					continue
+				}
+				fmt.Fprintf(os.Stderr, "%v\n", err)
 			} else {
 				switch typ {
 				case 1:
 					// Since packets are padded to be aligned, text packets
 					// might contain trailing zeros.
 					data = bytes.TrimRight(data, "\000")
-					fmt.Printf("%s", data)
+					if jsonOutput() {
+						emit("debug_text", jsonDebugText{Text: string(data)})
+					} else {
+						fmt.Printf("%s", data)
+					}
 				default:
 					// ignoring unknown packet type
 				}
@@ -748,7 +1100,7 @@ func cmdDriverInstall(cmd *cobra.Command, args []string) error {
 	return windriver.Install()
 }
 
-func main() {
+func newRootCmd() *cobra.Command {
 	var cmdList = &cobra.Command{
 		Use:          "list",
 		Aliases:      []string{"l"},
@@ -757,18 +1109,19 @@ func main() {
 		RunE:         cmdList,
 		SilenceUsage: true,
 	}
-	cmdList.Flags().BoolVarP(&flagVerbose, "verbose", "v", false, "also show hardware/firmware version of each board")
+	cmdList.Flags().BoolVarP(&flagVerbose, "verbose", "v", false, "also show hardware/firmware version and capabilities of each board")
 
 	var cmdUpload = &cobra.Command{
-		Use:          "upload [file]",
-		Aliases:      []string{"u"},
-		Short:        "upload data to 64drive",
-		Long:         `Upload a binary file to 64drive, on the specified bank`,
-		RunE:         cmdUpload,
-		Args:         cobra.ExactArgs(1),
-		SilenceUsage: true,
-	}
-	cmdUpload.Flags().VarP(&flagOffset, "offset", "o", "offset in memory at which the file will be uploaded")
+		Use:               "upload [file]",
+		Aliases:           []string{"u"},
+		Short:             "upload data to 64drive",
+		Long:              `Upload a binary file to 64drive, on the specified bank`,
+		RunE:              cmdUpload,
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: completeFiles(romExtensions),
+		SilenceUsage:      true,
+	}
+	cmdUpload.Flags().VarP(&flagOffset, "offset", "o", "offset in memory at which the file will be uploaded (or N64 PI address)")
 	cmdUpload.Flags().VarP(&flagSize, "size", "s", "size of data to upload (default: file size)")
 	cmdUpload.Flags().StringVarP(&flagBank, "bank", "b", "rom", "bank where data should be uploaded")
 	cmdUpload.Flags().BoolVarP(&flagAutoCic, "autocic", "c", false, "autoset CIC after upload (default: true if uploading a ROM)")
@@ -776,6 +1129,7 @@ func main() {
 	cmdUpload.Flags().BoolVarP(&flagAutoExtended, "extended", "e", false, "set extended mode after upload (default: true if uploading a >64Mb ROM)")
 	cmdUpload.Flags().BoolVarP(&flagVerbose, "verbose", "v", false, "be verbose")
 	cmdUpload.Flags().IntVarP(&flagByteswapU, "byteswap", "w", -1, "byteswap format: 0=none, 2=16bit, 4=32bit, -1=autodetect")
+	cmdUpload.Flags().BoolVar(&flagDryRun, "dry-run", false, dryRunUsage)
 	pflagAutoCic = cmdUpload.Flag("autocic")
 	pflagAutoSave = cmdUpload.Flag("autosave")
 	pflagAutoExtended = cmdUpload.Flag("extended")
@@ -785,17 +1139,19 @@ func main() {
 		Aliases: []string{"d"},
 		Short:   "download data from 64drive",
 		Long: `Download a binary file from 64drive, on the specified bank.
-Supported banks are: rom, sram256, sram768, flash, flash_pokstad2, eeprom.`,
+Supported banks are: ` + strings.Join(bankNames(), ", ") + `.
+The size can be omitted for save banks, which have a fixed size. The offset can also be
+specified as a N64 PI address (eg: 0x10001000), which is translated to the corresponding bank.`,
 		RunE:         cmdDownload,
 		Args:         cobra.ExactArgs(1),
 		SilenceUsage: true,
 	}
-	cmdDownload.Flags().VarP(&flagOffset, "offset", "o", "offset in memory at which the file will be uploaded")
-	cmdDownload.Flags().VarP(&flagSize, "size", "s", "size of data to download")
+	cmdDownload.Flags().VarP(&flagOffset, "offset", "o", "offset in memory from which the file will be downloaded (or N64 PI address)")
+	cmdDownload.Flags().VarP(&flagSize, "size", "s", "size of data to download (default: whole bank, for save banks)")
 	cmdDownload.Flags().StringVarP(&flagBank, "bank", "b", "rom", "bank where data should be uploaded")
 	cmdDownload.Flags().BoolVarP(&flagVerbose, "verbose", "v", false, "be verbose")
 	cmdDownload.Flags().IntVarP(&flagByteswapD, "byteswap", "w", 0, "byteswap format: 0=none, 2=16bit, 4=32bit")
-	cmdDownload.MarkFlagRequired("size")
+	pflagByteswapD = cmdDownload.Flag("byteswap")
 
 	var cmdCic = &cobra.Command{
 		Use:     "cic [type]",
@@ -809,11 +1165,13 @@ will be transferred from 64drive and analyzed, and the correct CIC variant will
 
   g64drive cic auto
     -- autodetect and set CIC type from the currently-loaded ROM header.`,
-		RunE:         cmdCic,
-		Args:         cobra.ExactArgs(1),
-		SilenceUsage: true,
+		RunE:              cmdCic,
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: completeValues(cicNames),
+		SilenceUsage:      true,
 	}
 	cmdCic.Flags().BoolVarP(&flagVerbose, "verbose", "v", false, "be verbose")
+	cmdCic.Flags().BoolVar(&flagDryRun, "dry-run", false, dryRunUsage)
 
 	var cmdSaveType = &cobra.Command{
 		Use:     "savetype [type]",
@@ -821,14 +1179,16 @@ will be transferred from 64drive and analyzed, and the correct CIC variant will
 		Short:   "change the emulated save type",
 		Long: `Change the variant of save memory that the 64drive emulates.
 The save type can be specified using one of the following names:
-"none", "eeprom4kbit", "eeprom16kbit", "sram256kbit", "flash1mbit", "sram768kbit", "flash1mbit_pokstad2".`,
+` + strings.Join(saveTypeNames(), ", ") + `.`,
 		Example: `  g64drive savetype eeprom16kbit     
     -- sets save type emulation to EEPROM with 16Kbit of space.`,
-		RunE:         cmdSaveType,
-		Args:         cobra.ExactArgs(1),
-		SilenceUsage: true,
+		RunE:              cmdSaveType,
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: completeValues(saveTypeNames),
+		SilenceUsage:      true,
 	}
 	cmdSaveType.Flags().BoolVarP(&flagVerbose, "verbose", "v", false, "be verbose")
+	cmdSaveType.Flags().BoolVar(&flagDryRun, "dry-run", false, dryRunUsage)
 
 	var cmdExtended = &cobra.Command{
 		Use:     "extended [bool]",
@@ -839,50 +1199,110 @@ This is required to run ROMs larger than 64 MiB, because otherwise the upper par
 be accessible. Please notice that extended mode is only available on 64Drive HW2 with firmware >= 2.06.`,
 		Example: `  g64drive extended true     
     -- enable extended mode.`,
-		RunE:         cmdExtended,
-		Args:         cobra.ExactArgs(1),
-		SilenceUsage: true,
+		RunE:              cmdExtended,
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: completeValues(boolNames),
+		SilenceUsage:      true,
 	}
 	cmdExtended.Flags().BoolVarP(&flagVerbose, "verbose", "v", false, "be verbose")
+	cmdExtended.Flags().BoolVar(&flagDryRun, "dry-run", false, dryRunUsage)
 
 	var cmdFirmwareInfo = &cobra.Command{
 		Use:   "info [file.rpk]",
 		Short: "show information on 64drive firmware file",
 		Example: `  g64drive firmware info 64drive_firm_hw2_205.rpk
 	-- show information on the specified firwmare file.`,
-		RunE:         cmdFirmwareInfo,
-		Args:         cobra.ExactArgs(1),
-		SilenceUsage: true,
+		RunE:              cmdFirmwareInfo,
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: completeFiles(firmwareExtensions),
+		SilenceUsage:      true,
 	}
 
 	var cmdFirmwareExtract = &cobra.Command{
 		Use:   "extract [file.rpk]",
 		Short: "extract the raw binary firmware",
 		Long: `extract the raw binary firmware contained in the RPK firmware container.
-By default, the original name is used (eg: firmware.bin), but a different file name can be specified`,
+By default, the original name is used (eg: firmware.bin), but a different file name can be specified
+with --out-file (--output is the global output format).`,
 		Example: `  g64drive firmware extract 64drive_firm_hw2_205.rpk
-	-- extract the raw binary firmware from the firmware container.`,
-		RunE:         cmdFirmwareExtract,
-		Args:         cobra.ExactArgs(1),
-		SilenceUsage: true,
+	-- extract the raw binary firmware from the firmware container.
+
+  g64drive firmware extract 64drive_firm_hw2_205.rpk -f firm205.bin
+	-- extract the raw binary firmware to firm205.bin.`,
+		RunE:              cmdFirmwareExtract,
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: completeFiles(firmwareExtensions),
+		SilenceUsage:      true,
 	}
-	cmdFirmwareExtract.Flags().StringVarP(&flagFwExtractOut, "output", "o", "", "output file (default: original name)")
+	cmdFirmwareExtract.Flags().StringVarP(&flagFwExtractOut, "out-file", "f", "", "output file (default: original name)")
 
 	var cmdFirmwareUpgrade = &cobra.Command{
-		Use:   "upgrade [file.rpk]",
+		Use:   "upgrade [file.rpk | --from dir]",
 		Short: "upgrade 64drive firmware",
+		Long: `Upgrade the 64drive firmware, as contained in the RPK firmware container.
+Bootloader RPKs are refused: the command sequence that flashes a bootloader is not
+documented, and a failed bootloader upgrade can only be recovered through JTAG.`,
 		Example: `  g64drive firmware upgrade 64drive_firm_hw2_205.rpk
-	-- install the firmware upgrade.`,
-		RunE:         cmdFirmwareUpgrade,
+	-- install the firmware upgrade.
+
+  g64drive firmware upgrade --from firmwares/
+	-- install the newest firmware found in firmwares/, showing what changed.`,
+		RunE:              cmdFirmwareUpgrade,
+		Args:              cobra.MaximumNArgs(1),
+		ValidArgsFunction: completeFiles(firmwareExtensions),
+		SilenceUsage:      true,
+	}
+	cmdFirmwareUpgrade.Flags().StringVar(&flagFwFrom, "from", "", "directory of RPK archives where to pick the newest compatible firmware")
+	cmdFirmwareUpgrade.Flags().BoolVarP(&flagUpgradeYes, "yes", "y", false, "do not ask for confirmation, for unattended upgrades")
+	cmdFirmwareUpgrade.Flags().BoolVar(&flagAllowDowngrade, "allow-downgrade", false, "allow installing an older (or the same) firmware version")
+	cmdFirmwareUpgrade.Flags().BoolVarP(&flagVerbose, "verbose", "v", false, "be verbose")
+	cmdFirmwareUpgrade.Flags().BoolVar(&flagDryRun, "dry-run", false, dryRunUsage)
+
+	var cmdFirmwarePack = &cobra.Command{
+		Use:   "pack [bitstream] [metadata.yaml] [file.rpk]",
+		Short: "create a RPK firmware container",
+		Long: `Create a RPK firmware container from a raw binary firmware (or bootloader), and a YAML
+file with the metadata. The metadata file has the following format:
+
+` + fwPackExample,
+		Example: `  g64drive firmware pack firmware.bin firmware.yaml 64drive_firm_hw2_205.rpk
+	-- create the firmware container.`,
+		RunE:         cmdFirmwarePack,
+		Args:         cobra.ExactArgs(3),
+		SilenceUsage: true,
+	}
+	cmdFirmwarePack.Flags().BoolVarP(&flagVerbose, "verbose", "v", false, "be verbose")
+
+	var cmdFirmwareValidate = &cobra.Command{
+		Use:   "validate [file.rpk]",
+		Short: "check the integrity of a RPK firmware container",
+		Long: `Check the integrity of a RPK firmware container: the CRC of every blob, the structure
+of the container (missing, duplicate or unknown blobs), the size of the asset and the
+consistency of the metadata. All the problems found are reported.`,
+		Example:           `  g64drive firmware validate 64drive_firm_hw2_205.rpk`,
+		RunE:              cmdFirmwareValidate,
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: completeFiles(firmwareExtensions),
+		SilenceUsage:      true,
+	}
+
+	var cmdFirmwareList = &cobra.Command{
+		Use:   "list [dir]",
+		Short: "list the RPK firmware containers in a directory",
+		Long: `List the RPK firmware containers found in a directory, grouped by product magic and
+hardware variant, newest first.`,
+		Example:      `  g64drive firmware list firmwares/`,
+		RunE:         cmdFirmwareList,
 		Args:         cobra.ExactArgs(1),
 		SilenceUsage: true,
 	}
+	cmdFirmwareList.Flags().BoolVarP(&flagVerbose, "verbose", "v", false, "be verbose")
 
 	var cmdFirmware = &cobra.Command{
 		Use:   "firmware",
 		Short: "manage firmware/bootloader upgrades",
 	}
-	cmdFirmware.AddCommand(cmdFirmwareUpgrade, cmdFirmwareInfo, cmdFirmwareExtract)
+	cmdFirmware.AddCommand(cmdFirmwareUpgrade, cmdFirmwareInfo, cmdFirmwareExtract, cmdFirmwarePack, cmdFirmwareValidate, cmdFirmwareList)
 	cmdFirmware.PersistentFlags().BoolVarP(&flagVerbose, "verbose", "v", false, "be verbose")
 
 	var cmdDebug = &cobra.Command{
@@ -892,6 +1312,343 @@ By default, the original name is used (eg: firmware.bin), but a different file n
 	-- see the output of the program`,
 		RunE: cmdDebug,
 	}
+	cmdDebug.Flags().BoolVarP(&flagReconnect, "reconnect", "r", false, "wait for the 64drive to be reattached if it gets disconnected")
+
+	var cmdWait = &cobra.Command{
+		Use:   "wait",
+		Short: "wait for a 64drive device to be attached",
+		Long: `Block until a 64drive device is attached to this computer (or, with --serial, the
+64drive with that serial number). This is useful in scripts that run right after the
+64drive is plugged in or power-cycled.`,
+		Example: `  g64drive wait --timeout 30s && g64drive upload myrom.z64
+	-- wait up to 30 seconds for the 64drive, then upload a ROM.`,
+		RunE:         cmdWait,
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+	}
+	cmdWait.Flags().DurationVarP(&flagWaitTimeout, "timeout", "t", 0, "maximum time to wait (default: wait forever)")
+
+	var cmdResetLink = &cobra.Command{
+		Use:   "reset-link",
+		Short: "recover a 64drive that stopped responding",
+		Long: `Try to recover a 64drive whose USB link got stuck (eg: after an interrupted transfer),
+without power-cycling it. The FTDI buffers are purged, any stale data is drained,
+the USB FIFO mode is reset, and finally the device is checked with a version request.`,
+		RunE:         cmdResetLink,
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+	}
+	cmdResetLink.Flags().BoolVarP(&flagVerbose, "verbose", "v", false, "be verbose")
+
+	var cmdDaemon = &cobra.Command{
+		Use:   "daemon",
+		Short: "share attached 64drive devices with other g64drive processes",
+		Long: `Run a local daemon that owns all the attached 64drive devices, and multiplexes
+commands coming from other g64drive processes. While the daemon is running, other
+g64drive commands transparently go through it, so that for instance "g64drive upload"
+can be used while "g64drive debug" is attached in another terminal.
+Without the daemon, a 64drive can only be used by one process at a time.`,
+		Example: `  g64drive daemon &
+  g64drive debug
+	-- in another terminal, while debug is running:
+  g64drive upload myrom.z64`,
+		RunE:         cmdDaemon,
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+	}
+
+	var cmdBench = &cobra.Command{
+		Use:   "bench",
+		Short: "benchmark the USB link and tune transfer parameters",
+		Long: `Measure upload and download throughput, and command roundtrip latency, across
+different transfer chunk sizes and FTDI latency timer settings. The best profile is saved
+for the attached device (identified by its serial number), and used by later transfers.
+The beginning of CARTROM is used as scratch area, and restored at the end of the benchmark.`,
+		RunE:         cmdBench,
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+	}
+	cmdBench.Flags().VarP(&flagBenchSize, "size", "s", "size of data transferred for each measurement")
+	cmdBench.Flags().BoolVar(&flagBenchSave, "save", true, "save the best profile for this device")
+	cmdBench.Flags().BoolVarP(&flagVerbose, "verbose", "v", false, "be verbose")
+
+	var cmdDoctor = &cobra.Command{
+		Use:   "doctor",
+		Short: "diagnose problems accessing the 64drive",
+		Long: `Check that 64drive can be accessed: USB enumeration through libusb and libftdi,
+the FTDI devices found with their USB strings, permissions and kernel drivers (on Linux),
+and a version request roundtrip to each 64drive, with its timing. Each check reports
+a hint to fix the problem, if any.`,
+		RunE:         cmdDoctor,
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+	}
+
+	var cmdMemtest = &cobra.Command{
+		Use:   "memtest",
+		Short: "test the SDRAM of 64drive",
+		Long: `Test the SDRAM of 64drive, by writing deterministic patterns (walking bits,
+address-in-address and pseudo-random data) to the whole CARTROM bank and reading
+them back. On HW2, extended mode is turned on to test all the memory, and restored
+at the end. Failing addresses are reported with the bits that differ from what
+was written.
+
+The quick mode (default) tests each kind of pattern once; --full also tests the
+inverted patterns, so that each bit is checked both at 0 and at 1.
+
+The ROM loaded on 64drive is overwritten by the test, so it must be confirmed
+(or run with --yes).`,
+		RunE:         cmdMemtest,
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+	}
+	cmdMemtest.Flags().BoolVar(&flagMemtestFull, "full", false, "also test the inverted patterns")
+	cmdMemtest.Flags().BoolVarP(&flagMemtestYes, "yes", "y", false, "do not ask for confirmation before overwriting the ROM")
+	cmdMemtest.Flags().BoolVarP(&flagVerbose, "verbose", "v", false, "be verbose")
+
+	var cmdRaw = &cobra.Command{
+		Use:   "raw <cmd> [args...]",
+		Short: "send a raw command to 64drive",
+		Long: `Send an arbitrary command to 64drive, and show the response as an hexdump. This is
+useful to experiment with commands that are not (yet) supported by g64drive.
+
+The command can be specified by number (eg: 0x80) or by name (eg: VersionRequest).
+Arguments are 32-bit numbers (decimal, or hex with the 0x prefix). The response size
+must be specified with --out-size, and must match exactly what 64drive sends back,
+otherwise the command fails and the USB link might need a "g64drive reset-link".
+Notice that changes made with raw commands are not recorded in "g64drive status".
+
+Examples:
+	g64drive raw VersionRequest --out-size 8
+	-- same as "g64drive list -v"
+
+	g64drive raw 0x72 0x80000001
+	-- set CIC to 6102`,
+		RunE:              cmdRaw,
+		Args:              cobra.MinimumNArgs(1),
+		ValidArgsFunction: completeValues(commandByteNames),
+		SilenceUsage:      true,
+	}
+	cmdRaw.Flags().StringVar(&flagRawIn, "in", "", "file with the payload to send after the arguments")
+	cmdRaw.Flags().Var(&flagRawOutSize, "out-size", "size of the response sent by 64drive")
+	cmdRaw.Flags().BoolVarP(&flagVerbose, "verbose", "v", false, "be verbose")
+
+	var cmdMemDump = &cobra.Command{
+		Use:   "dump [offset] [size]",
+		Short: "show the contents of a bank in hexadecimal",
+		Long: `Show the contents of a bank in hexadecimal, as big-endian 32-bit words.
+The offset defaults to 0, and can also be a N64 PI address. The size defaults to the
+whole bank for save banks, and to 256 bytes for the ROM. With --output json, large
+ranges are reported as multiple "memory" records of 64 KiB each.`,
+		Example: `  g64drive mem dump --bank eeprom 0x0 0x200
+	-- show the first 512 bytes of the EEPROM.
+
+  g64drive mem dump 0x10000040 0x40
+	-- show 64 bytes of ROM at PI address 0x10000040.`,
+		RunE:         cmdMemDump,
+		Args:         cobra.MaximumNArgs(2),
+		SilenceUsage: true,
+	}
+
+	var cmdMemPoke = &cobra.Command{
+		Use:   "poke [offset] [type:value]...",
+		Short: "write values into a bank",
+		Long: `Write one or more typed values into a bank, at the specified offset (or N64 PI address).
+Values are written one after the other. Supported types are u8, u16, u32, u64 (stored
+big-endian, like the N64 does) and hex (a sequence of bytes).`,
+		Example: `  g64drive mem poke --bank sram256 0x10 u32:0xDEADBEEF
+	-- write a 32-bit word at offset 0x10 of SRAM.
+
+  g64drive mem poke --bank eeprom 0x0 hex:0011223344556677
+	-- write 8 bytes at the beginning of EEPROM.`,
+		RunE:         cmdMemPoke,
+		Args:         cobra.MinimumNArgs(2),
+		SilenceUsage: true,
+	}
+
+	var cmdMemFill = &cobra.Command{
+		Use:   "fill [byte]",
+		Short: "fill a bank with a byte value",
+		Long: `Fill a bank with the specified byte value. By default, the whole bank is filled
+for save banks; use --offset and --size to fill only a portion.`,
+		Example: `  g64drive mem fill --bank flash 0xFF
+	-- erase the FlashRAM.`,
+		RunE:         cmdMemFill,
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+	}
+	cmdMemFill.Flags().VarP(&flagOffset, "offset", "o", "offset in memory at which the fill starts (or N64 PI address)")
+	cmdMemFill.Flags().VarP(&flagSize, "size", "s", "number of bytes to fill (default: whole bank, for save banks)")
+
+	var cmdMemDiff = &cobra.Command{
+		Use:   "diff [snapshot]",
+		Short: "compare a bank with a previous snapshot",
+		Long: `Compare the contents of a bank with a snapshot file (eg: previously created with
+"g64drive download"), and show the ranges of bytes that differ.`,
+		Example: `  g64drive download --bank eeprom before.eep
+  g64drive mem diff --bank eeprom before.eep
+	-- show what changed in EEPROM since the snapshot was taken.`,
+		RunE:         cmdMemDiff,
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+	}
+	cmdMemDiff.Flags().VarP(&flagOffset, "offset", "o", "offset in memory that corresponds to the beginning of the snapshot")
+
+	var cmdMem = &cobra.Command{
+		Use:   "mem",
+		Short: "inspect and modify the memory of any bank",
+	}
+	cmdMem.AddCommand(cmdMemDump, cmdMemPoke, cmdMemFill, cmdMemDiff)
+	cmdMem.PersistentFlags().StringVarP(&flagBank, "bank", "b", "rom", "bank to operate on")
+	cmdMem.PersistentFlags().BoolVarP(&flagVerbose, "verbose", "v", false, "be verbose")
+
+	var cmdSaveWatch = &cobra.Command{
+		Use:   "watch",
+		Short: "show changes to the save memory while a game is running",
+		Long: `Poll the save memory at regular intervals while a game is running, and show the
+ranges of bytes that changed, with their old and new values. Optionally, every version
+of the save memory can be recorded into a directory, as a sequence of numbered files.
+By default, the save bank is the one of the save type configured on the 64drive by
+"g64drive upload", "savetype", "run" or "snapshot load", if it is still known (see
+"g64drive status").`,
+		Example: `  g64drive save watch
+	-- show changes to the save memory of the running game every second.
+
+  g64drive save watch --bank eeprom
+	-- show changes to the EEPROM every second.
+
+  g64drive save watch --bank sram256 -i 200ms --record saves/
+	-- poll SRAM 5 times per second, and record all versions in saves/.`,
+		RunE:         cmdSaveWatch,
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+	}
+	cmdSaveWatch.Flags().StringVarP(&flagSaveBank, "bank", "b", "", "save bank to watch (eeprom, sram256, sram768, flash, flash_pokstad2; default: bank of the configured save type)")
+	cmdSaveWatch.Flags().DurationVarP(&flagSaveInterval, "interval", "i", time.Second, "polling interval")
+	cmdSaveWatch.Flags().StringVarP(&flagSaveRecord, "record", "r", "", "directory where every version of the save memory is recorded")
+	cmdSaveWatch.Flags().BoolVarP(&flagVerbose, "verbose", "v", false, "be verbose")
+
+	var cmdSave = &cobra.Command{
+		Use:   "save",
+		Short: "work with the save memory of the running game",
+	}
+	cmdSave.AddCommand(cmdSaveWatch)
+
+	var cmdSnapshotSave = &cobra.Command{
+		Use:   "save [file]",
+		Short: "save a snapshot of the 64drive into an archive",
+		Long: `Save everything needed to reproduce a session into a single archive: the ROM
+(or only its MD5, if the ROM file is specified with --rom), the save memory, the CIC,
+the save type and the extended mode.
+Since 64drive cannot report its current configuration, the save type, the extended mode
+and the ROM size default to the ones recorded when the 64drive was configured by
+g64drive (see "g64drive status"); if they are unknown, the save type must be specified,
+and the whole ROM bank is saved. The CIC is detected from the ROM header by default.`,
+		Example: `  g64drive snapshot save bug123.g64snap
+	-- save the ROM, the save memory and the configuration last set by g64drive.
+
+  g64drive snapshot save --savetype eeprom4kbit --size 8M bug123.g64snap
+	-- save the first 8 MiB of ROM, together with the EEPROM contents.
+
+  g64drive snapshot save --savetype sram256kbit --rom game.z64 bug123.g64snap
+	-- save a snapshot that refers to a local ROM file.`,
+		RunE:         cmdSnapshotSave,
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+	}
+	cmdSnapshotSave.Flags().StringVarP(&flagSnapCic, "cic", "c", "auto", "CIC type (or \"auto\" to detect it from the ROM)")
+	cmdSnapshotSave.Flags().StringVarP(&flagSnapSaveType, "savetype", "t", "", "save type ("+strings.Join(saveTypeNames(), ", ")+"; default: as last configured)")
+	cmdSnapshotSave.Flags().BoolVarP(&flagSnapExtended, "extended", "e", false, "extended mode is enabled (default: as last configured)")
+	cmdSnapshotSave.Flags().StringVarP(&flagSnapRom, "rom", "r", "", "local ROM file loaded on the 64drive (only its MD5 is saved)")
+	cmdSnapshotSave.Flags().VarP(&flagSnapRomSize, "size", "s", "size of the ROM to save (default: size of the last uploaded ROM, or whole bank)")
+
+	var cmdSnapshotLoad = &cobra.Command{
+		Use:   "load [file]",
+		Short: "restore a snapshot of the 64drive",
+		Long: `Restore a snapshot created with "g64drive snapshot save": upload the ROM, configure
+the CIC, the save type and the extended mode, and restore the save memory.
+If the snapshot doesn't include the ROM, it is searched next to the snapshot file,
+or it can be specified with --rom.`,
+		Example:      `  g64drive snapshot load bug123.g64snap`,
+		RunE:         cmdSnapshotLoad,
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+	}
+	cmdSnapshotLoad.Flags().StringVarP(&flagSnapRom, "rom", "r", "", "local ROM file, if not included in the snapshot")
+
+	var cmdSnapshot = &cobra.Command{
+		Use:   "snapshot",
+		Short: "save and restore the whole 64drive state",
+	}
+	cmdSnapshot.AddCommand(cmdSnapshotSave, cmdSnapshotLoad)
+	cmdSnapshot.PersistentFlags().BoolVarP(&flagVerbose, "verbose", "v", false, "be verbose")
+
+	var cmdStatus = &cobra.Command{
+		Use:   "status",
+		Short: "show the current configuration of the 64drive",
+		Long: `Show the hardware and firmware version of the 64drive, together with the CIC, save type
+and extended mode last configured by g64drive and the last uploaded ROM.
+The 64drive cannot report its configuration, so this is the state recorded by g64drive
+on this computer; it is shown as unknown when it might be stale (eg: the 64drive was
+power-cycled, upgraded or used by another tool).`,
+		RunE:         cmdStatus,
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+	}
+
+	var cmdRun = &cobra.Command{
+		Use:   "run",
+		Short: "load a game as described by a launch profile",
+		Long: `Load a game as described by a launch profile of the configuration file: upload the ROM,
+apply the patches, set the CIC, the save type and the extended mode, and load the save memory.
+Flags specified on the command line override the profile, which overrides the [defaults].
+
+Configuration is read from ` + "`" + `g64drive/config.toml` + "`" + ` in the user configuration directory
+(eg: ~/.config on Linux), and then from ./` + localConfigName + `, which overrides it. The [defaults]
+section sets default values for the flags of every command. Example:
+
+` + configExample,
+		Example: `  g64drive run -p mygame
+	-- load the game described by profile "mygame".
+
+  g64drive run -p mygame --savetype sram256kbit
+	-- same, but force a different save type.`,
+		RunE:         cmdRun,
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+	}
+	cmdRun.Flags().StringVarP(&flagRunProfile, "profile", "p", "", "name of the launch profile")
+	cmdRun.Flags().StringVarP(&flagRunRom, "rom", "r", "", "ROM file (overrides the profile)")
+	cmdRun.Flags().StringVarP(&flagRunCic, "cic", "c", "", "CIC type, or auto (overrides the profile)")
+	cmdRun.Flags().StringVarP(&flagRunSaveType, "savetype", "t", "", "save type, or auto (overrides the profile)")
+	cmdRun.Flags().BoolVarP(&flagRunExtended, "extended", "e", false, "extended mode (overrides the profile)")
+	cmdRun.Flags().StringVar(&flagRunSave, "save", "", "save memory file to load (overrides the profile)")
+	cmdRun.Flags().BoolVarP(&flagVerbose, "verbose", "v", false, "be verbose")
+	cmdRun.MarkFlagRequired("profile")
+
+	var cmdShell = &cobra.Command{
+		Use:   "shell",
+		Short: "interactive shell that keeps the 64drive open",
+		Long: `Open the 64drive once, and execute g64drive commands on it interactively, with history
+and tab completion. Commands are typed without the "g64drive" prefix. This is faster than
+running separate g64drive processes, as the device is not enumerated and opened every time.
+The shell also supports:
+  debug [on|off]   show the output of the running program in background (like "g64drive debug")
+  exit             close the shell (also CTRL+D)
+If the standard input is not a terminal, commands are read from it as a script (one per line,
+lines starting with # are ignored), stopping at the first error.`,
+		Example: `  g64drive shell
+  g64drive> upload myrom.z64
+  g64drive> debug on
+  g64drive> mem dump --bank eeprom 0 0x40
+
+  g64drive shell < setup.txt
+	-- run the commands in setup.txt.`,
+		RunE:         cmdShell,
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+	}
+	cmdShell.Flags().BoolVarP(&flagVerbose, "verbose", "v", false, "be verbose")
 
 	var cmdDriverInstall = &cobra.Command{
 		Use:   "driverinstall",
@@ -904,14 +1661,45 @@ No proprietary FTDI/D2XX is required and will not be installed.`,
 	}
 
 	var rootCmd = &cobra.Command{
-		Use: "g64drive",
+		Use:  "g64drive",
+		Long: "g64drive is a command-line tool for the 64drive, the Nintendo 64 development cartridge.\n\n" + exitCodesHelp(),
 	}
 	rootCmd.PersistentFlags().BoolVarP(&flagQuiet, "quiet", "q", false, "do not show any output unless an error occurs")
-	rootCmd.AddCommand(cmdList, cmdUpload, cmdDownload, cmdCic, cmdSaveType, cmdExtended, cmdFirmware, cmdDebug)
+	rootCmd.PersistentFlags().BoolVar(&flagWait, "wait", false, "wait for a 64drive device to be attached if none is found")
+	rootCmd.PersistentFlags().StringVar(&flagSerial, "serial", "", "serial number of the 64drive to use, if more than one is attached")
+	rootCmd.PersistentFlags().StringVar(&flagOutput, "output", outputText, "output format: text, or json for a stream of JSON objects (one per line)")
+	rootCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		// Defaults from the configuration files, for flags not specified on the command line
+		cfg, err := loadConfig()
+		if err != nil {
+			return err
+		}
+		if err := cfg.applyDefaults(cmd); err != nil {
+			return err
+		}
+		if err := checkOutputFlag(); err != nil {
+			return err
+		}
+		// Errors are emitted as JSON objects by main
+		cmd.SilenceErrors = jsonOutput()
+		return nil
+	}
+	rootCmd.SetFlagErrorFunc(func(cmd *cobra.Command, err error) error {
+		return usageErrorf("%v", err)
+	})
+	rootCmd.AddCommand(cmdList, cmdUpload, cmdDownload, cmdCic, cmdSaveType, cmdExtended, cmdFirmware, cmdDebug, cmdWait, cmdResetLink, cmdDaemon, cmdBench, cmdMem, cmdSave, cmdSnapshot, cmdStatus, cmdRun, cmdRaw, cmdDoctor, cmdMemtest, cmdShell)
 	if runtime.GOOS == "windows" {
 		rootCmd.AddCommand(cmdDriverInstall)
 	}
-	if rootCmd.Execute() != nil {
-		os.Exit(1)
+	registerCompletions(rootCmd)
+	return rootCmd
+}
+
+func main() {
+	if err := newRootCmd().Execute(); err != nil {
+		if jsonOutput() {
+			emitError(err)
+		}
+		os.Exit(exitCode(err))
 	}
 }
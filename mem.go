@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/rasky/g64drive/drive64"
+	"github.com/spf13/cobra"
+)
+
+// Default number of bytes shown by "mem dump" on banks without a fixed size
+const memDumpDefaultSize = 256
+
+// Size of the chunks processed by "mem dump" and "mem fill", so that large
+// ranges are never held in memory all at once
+const memChunkSize = 64 * 1024
+
+// parseMemAddress parses a memory offset given on the command line, which can
+// also be a N64 PI address, and translates it to a bank and offset.
+func parseMemAddress(text string, bank drive64.Bank) (drive64.Bank, uint32, error) {
+	var addr sizeUnit
+	if err := addr.Set(text); err != nil || addr.size < 0 || addr.size > 0xFFFFFFFF {
+		return bank, 0, usageErrorf("invalid address: %v", text)
+	}
+	bank, offset := drive64.TranslatePIAddress(uint32(addr.size), bank)
+	return bank, offset, nil
+}
+
+// parseMemValue parses a typed value to be written in memory, in the format
+// "type:value". Supported types are u8, u16, u32, u64 (stored big-endian,
+// like the N64 does) and hex (a raw sequence of bytes).
+func parseMemValue(text string) ([]byte, error) {
+	idx := strings.IndexByte(text, ':')
+	if idx < 0 {
+		return nil, usageErrorf("invalid value %q (expected type:value, eg: u32:0xDEADBEEF)", text)
+	}
+	typ, val := text[:idx], text[idx+1:]
+
+	if typ == "hex" {
+		return hex.DecodeString(val)
+	}
+
+	var buf [8]byte
+	var size int
+	switch typ {
+	case "u8":
+		size = 1
+	case "u16":
+		size = 2
+	case "u32":
+		size = 4
+	case "u64":
+		size = 8
+	default:
+		return nil, usageErrorf("invalid value type %q (supported: u8, u16, u32, u64, hex)", typ)
+	}
+	v, err := strconv.ParseUint(val, 0, size*8)
+	if err != nil {
+		return nil, usageErrorf("invalid %s value: %v", typ, val)
+	}
+	binary.BigEndian.PutUint64(buf[:], v)
+	return buf[8-size:], nil
+}
+
+// hexdump writes data in hexadecimal format, as a sequence of big-endian 32-bit
+// words (which is how the N64 sees memory), followed by the ASCII representation.
+func hexdump(w io.Writer, data []byte, base uint32) {
+	for off := 0; off < len(data); off += 16 {
+		line := data[off:]
+		if len(line) > 16 {
+			line = line[:16]
+		}
+
+		fmt.Fprintf(w, "%08x ", base+uint32(off))
+		for i := 0; i < 16; i++ {
+			if i%4 == 0 {
+				fmt.Fprint(w, " ")
+			}
+			if i < len(line) {
+				fmt.Fprintf(w, "%02x", line[i])
+			} else {
+				fmt.Fprint(w, "  ")
+			}
+		}
+
+		fmt.Fprint(w, "  |")
+		for _, c := range line {
+			if c < 0x20 || c >= 0x7F {
+				c = '.'
+			}
+			fmt.Fprintf(w, "%c", c)
+		}
+		fmt.Fprint(w, "|\n")
+	}
+}
+
+// memRange is a range of bytes that differ between two memory images
+type memRange struct {
+	Offset uint32
+	Old    []byte
+	New    []byte
+}
+
+// MarshalJSON encodes the bytes in hexadecimal, like printMemDiff does
+func (r memRange) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Offset uint32 `json:"offset"`
+		Old    string `json:"old"`
+		New    string `json:"new"`
+	}{r.Offset, hex.EncodeToString(r.Old), hex.EncodeToString(r.New)})
+}
+
+// memDiff compares two memory images, and returns the ranges of bytes that differ.
+// Ranges separated by less than 4 equal bytes are merged, to keep the output readable.
+func memDiff(old, new []byte, base uint32) []memRange {
+	const mergeGap = 4
+	var ranges []memRange
+
+	n := len(old)
+	if len(new) < n {
+		n = len(new)
+	}
+	for i := 0; i < n; {
+		if old[i] == new[i] {
+			i++
+			continue
+		}
+		start, end := i, i+1
+		for j := end; j < n && j < end+mergeGap; j++ {
+			if old[j] != new[j] {
+				end = j + 1
+			}
+		}
+		for end < n && old[end] != new[end] {
+			end++
+		}
+		ranges = append(ranges, memRange{base + uint32(start), old[start:end], new[start:end]})
+		i = end
+	}
+	return ranges
+}
+
+func printMemDiff(w io.Writer, ranges []memRange) {
+	for _, r := range ranges {
+		fmt.Fprintf(w, "%08x-%08x (%d bytes):\n", r.Offset, r.Offset+uint32(len(r.Old))-1, len(r.Old))
+		fmt.Fprintf(w, "  - %x\n", r.Old)
+		fmt.Fprintf(w, "  + %x\n", r.New)
+	}
+}
+
+// errMemRange is returned when a range exceeds the size of the bank
+func errMemRange(bf *drive64.BankFile, bank drive64.Bank) error {
+	return fmt.Errorf("range exceeds the size of bank %v (0x%x)", bank.Info().Name, bf.Size())
+}
+
+// memCheckRange verifies that a range is within the bank, before it is accessed
+func memCheckRange(bf *drive64.BankFile, bank drive64.Bank, offset uint32, size int64) error {
+	if size < 0 || int64(offset)+size > bf.Size() {
+		return errMemRange(bf, bank)
+	}
+	return nil
+}
+
+// memReadAt reads from a bank, reporting a readable error if the range
+// exceeds the bank size.
+func memReadAt(bf *drive64.BankFile, bank drive64.Bank, data []byte, offset uint32) error {
+	if _, err := bf.ReadAt(data, int64(offset)); err == io.EOF {
+		return errMemRange(bf, bank)
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// withMemBank opens the device and the specified bank, and calls f with it.
+// Like the other bulk transfers, the accesses to the bank can be aborted with CTRL+C.
+func withMemBank(bank drive64.Bank, f func(bf *drive64.BankFile) error) error {
+	dev, err := openDevice()
+	if err != nil {
+		return err
+	}
+	defer dev.Close()
+	return safeSigIntContext(func(ctx context.Context) error {
+		bf, err := dev.OpenBank(ctx, bank)
+		if err != nil {
+			return err
+		}
+		return f(bf)
+	})
+}
+
+// memRangeArgs parses the offset and (optional) size arguments of a mem command.
+// If the size is not specified, zero is returned.
+func memRangeArgs(bank drive64.Bank, offsetArg, sizeArg string) (drive64.Bank, uint32, int64, error) {
+	bank, offset, err := parseMemAddress(offsetArg, bank)
+	if err != nil {
+		return bank, 0, 0, err
+	}
+	var size int64
+	if sizeArg != "" {
+		var sz sizeUnit
+		if err := sz.Set(sizeArg); err != nil || sz.size <= 0 {
+			return bank, 0, 0, usageErrorf("invalid size: %v", sizeArg)
+		}
+		size = sz.size
+	}
+	return bank, offset, size, nil
+}
+
+func cmdMemDump(cmd *cobra.Command, args []string) error {
+	bank, err := flagBankParse()
+	if err != nil {
+		return err
+	}
+	offsetArg, sizeArg := "0", ""
+	if len(args) > 0 {
+		offsetArg = args[0]
+	}
+	if len(args) > 1 {
+		sizeArg = args[1]
+	}
+	bank, offset, size, err := memRangeArgs(bank, offsetArg, sizeArg)
+	if err != nil {
+		return err
+	}
+
+	return withMemBank(bank, func(bf *drive64.BankFile) error {
+		if size == 0 {
+			size = memDumpDefaultSize
+			if bank.Info().Fixed {
+				if int64(offset) >= bf.Size() {
+					return errMemRange(bf, bank)
+				}
+				size = bf.Size() - int64(offset)
+			}
+		}
+
+		if err := memCheckRange(bf, bank, offset, size); err != nil {
+			return err
+		}
+
+		// Chunks are a multiple of the hexdump line, so the output is the
+		// same as dumping the whole range at once.
+		buf := make([]byte, memChunkSize)
+		for done := int64(0); done < size; done += memChunkSize {
+			data := buf
+			if size-done < int64(len(data)) {
+				data = data[:size-done]
+			}
+			off := offset + uint32(done)
+			if err := memReadAt(bf, bank, data, off); err != nil {
+				return err
+			}
+			if jsonOutput() {
+				emit("memory", jsonMemory{Bank: bank.Info().Name, Offset: off, Data: hex.EncodeToString(data)})
+			} else {
+				hexdump(os.Stdout, data, off)
+			}
+		}
+		return nil
+	})
+}
+
+func cmdMemPoke(cmd *cobra.Command, args []string) error {
+	bank, err := flagBankParse()
+	if err != nil {
+		return err
+	}
+	bank, offset, err := parseMemAddress(args[0], bank)
+	if err != nil {
+		return err
+	}
+
+	var data []byte
+	for _, a := range args[1:] {
+		v, err := parseMemValue(a)
+		if err != nil {
+			return err
+		}
+		data = append(data, v...)
+	}
+
+	return withMemBank(bank, func(bf *drive64.BankFile) error {
+		vprintf("Writing %d bytes at %v:0x%x\n", len(data), bank.Info().Name, offset)
+		_, err := bf.WriteAt(data, int64(offset))
+		return err
+	})
+}
+
+func cmdMemFill(cmd *cobra.Command, args []string) error {
+	var val sizeUnit
+	if err := val.Set(args[0]); err != nil || val.size < 0 || val.size > 0xFF {
+		return usageErrorf("invalid fill value (must be a byte): %v", args[0])
+	}
+
+	bank, err := flagBankParse()
+	if err != nil {
+		return err
+	}
+	bank, offset, err := flagOffsetParse(bank)
+	if err != nil {
+		return err
+	}
+
+	size := flagSize.size
+	if size < 0 || (size == 0 && cmd.Flags().Changed("size")) {
+		return usageErrorf("invalid size value (must be positive)")
+	}
+
+	return withMemBank(bank, func(bf *drive64.BankFile) error {
+		if size == 0 {
+			if !bank.Info().Fixed {
+				return usageErrorf("--size is required to fill bank %v", bank.Info().Name)
+			}
+			if int64(offset) >= bf.Size() {
+				return errMemRange(bf, bank)
+			}
+			size = bf.Size() - int64(offset)
+		}
+
+		if err := memCheckRange(bf, bank, offset, size); err != nil {
+			return err
+		}
+
+		vprintf("Filling %v:0x%x-0x%x with 0x%02x\n", bank.Info().Name, offset, int64(offset)+size-1, val.size)
+		chunk := bytes.Repeat([]byte{byte(val.size)}, memChunkSize)
+		for done := int64(0); done < size; done += memChunkSize {
+			data := chunk
+			if size-done < int64(len(data)) {
+				data = data[:size-done]
+			}
+			if _, err := bf.WriteAt(data, int64(offset)+done); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func cmdMemDiff(cmd *cobra.Command, args []string) error {
+	snapshot, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+	if len(snapshot) == 0 {
+		return errors.New("snapshot file is empty")
+	}
+
+	bank, err := flagBankParse()
+	if err != nil {
+		return err
+	}
+	bank, offset, err := flagOffsetParse(bank)
+	if err != nil {
+		return err
+	}
+
+	data := make([]byte, len(snapshot))
+	err = withMemBank(bank, func(bf *drive64.BankFile) error {
+		return memReadAt(bf, bank, data, offset)
+	})
+	if err != nil {
+		return err
+	}
+
+	ranges := memDiff(snapshot, data, offset)
+	emit("diff", jsonMemDiff{Bank: bank.Info().Name, Ranges: ranges})
+	if len(ranges) == 0 {
+		printf("No differences\n")
+		return nil
+	}
+	if !jsonOutput() {
+		printMemDiff(os.Stdout, ranges)
+	}
+	return nil
+}
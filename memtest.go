@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/rasky/g64drive/drive64"
+	"github.com/spf13/cobra"
+)
+
+var (
+	flagMemtestFull bool
+	flagMemtestYes  bool
+)
+
+// Maximum number of failing addresses reported for each pattern
+const memtestMaxFailures = 16
+
+// memtestPattern is a deterministic test pattern: it returns the 32-bit word
+// to be written at each (word-aligned) offset.
+type memtestPattern struct {
+	name  string
+	quick bool // also used in quick mode
+	word  func(off uint32) uint32
+}
+
+// memtestHash scrambles the bits of x (it's the murmur3 finalizer), to produce
+// pseudo-random data that can be regenerated at any offset.
+func memtestHash(x uint32) uint32 {
+	x ^= x >> 16
+	x *= 0x85ebca6b
+	x ^= x >> 13
+	x *= 0xc2b2ae35
+	x ^= x >> 16
+	return x
+}
+
+// Patterns used by memtest. In quick mode, each kind of pattern is tested once;
+// full mode also tests the complement of each pattern, so that each bit is
+// tested both with 0 and 1.
+var memtestPatterns = []memtestPattern{
+	{"walking ones", true, func(off uint32) uint32 { return 1 << (off / 4 % 32) }},
+	{"walking zeros", false, func(off uint32) uint32 { return ^uint32(1 << (off / 4 % 32)) }},
+	{"address-in-address", true, func(off uint32) uint32 { return off }},
+	{"inverted address", false, func(off uint32) uint32 { return ^off }},
+	{"pseudo-random", true, func(off uint32) uint32 { return memtestHash(off) }},
+	{"inverted pseudo-random", false, func(off uint32) uint32 { return ^memtestHash(off) }},
+}
+
+// memtestReader generates the data of a pattern, as big-endian words
+type memtestReader struct {
+	pat *memtestPattern
+	off uint32
+}
+
+func (r *memtestReader) Read(buf []byte) (int, error) {
+	for i := range buf {
+		word := r.pat.word(r.off &^ 3)
+		buf[i] = byte(word >> (24 - 8*(r.off&3)))
+		r.off++
+	}
+	return len(buf), nil
+}
+
+// memFailure is a word that was read back different from what was written
+type memFailure struct {
+	Offset   uint32 `json:"offset"`
+	Expected uint32 `json:"expected"`
+	Read     uint32 `json:"read"`
+}
+
+// memtestChecker verifies that the data written to it matches a pattern
+type memtestChecker struct {
+	pat      *memtestPattern
+	off      uint32
+	cur      uint32
+	errors   int
+	bits     uint32 // bits that failed at least once
+	failures []memFailure
+}
+
+func (c *memtestChecker) Write(buf []byte) (int, error) {
+	for _, b := range buf {
+		c.cur = c.cur<<8 | uint32(b)
+		if c.off&3 == 3 {
+			addr := c.off &^ 3
+			if exp := c.pat.word(addr); c.cur != exp {
+				c.errors++
+				c.bits |= c.cur ^ exp
+				if len(c.failures) < memtestMaxFailures {
+					c.failures = append(c.failures, memFailure{addr, exp, c.cur})
+				}
+			}
+		}
+		c.off++
+	}
+	return len(buf), nil
+}
+
+func cmdMemtest(cmd *cobra.Command, args []string) error {
+	if jsonOutput() && !flagMemtestYes {
+		return usageErrorf("--yes is required with --output json, as the test cannot be confirmed interactively")
+	}
+
+	dev, err := openDevice()
+	if err != nil {
+		return err
+	}
+	defer dev.Close()
+	vprintf("64drive serial: %v\n", dev.Description().Serial)
+
+	// In dry-run mode, all the patterns would be kept in memory
+	if dev.IsDryRun() {
+		return usageErrorf("memtest cannot run in dry-run mode")
+	}
+
+	ctx, cancel := cmdContext()
+	defer cancel()
+	caps, err := dev.Capabilities(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Extended mode makes the whole SDRAM accessible as CARTROM
+	extended := caps.Supports(drive64.FeatureExtended)
+	size := caps.MaxROMSize()
+	mode := "quick"
+	if flagMemtestFull {
+		mode = "full"
+	}
+
+	warnf("the test overwrites the ROM loaded on the 64drive (serial %v)", dev.Description().Serial)
+	if !flagMemtestYes {
+		fmt.Printf("Do you want to proceed (Y/N):")
+		var resp string
+		if _, err := fmt.Scanln(&resp); err != nil || strings.ToLower(resp) != "y" {
+			return errNotConfirmed
+		}
+	}
+
+	// The previous extended mode is known only if it was recorded; 64drive
+	// starts with extended mode disabled.
+	prevExtended := false
+	if st, ok := currentState(ctx, dev); ok && st.Extended != nil {
+		prevExtended = *st.Extended
+	}
+	if extended {
+		vprintf("Set extended mode\n")
+		if err := setExtended(ctx, dev, true); err != nil {
+			return err
+		}
+	}
+
+	// Whatever happens, the ROM was (at least partially) overwritten by the test patterns
+	defer func() {
+		ctx, cancel := cmdContext()
+		defer cancel()
+		recordState(ctx, dev, true, func(st *deviceState) { st.Rom = nil })
+		if extended && !prevExtended {
+			vprintf("Restore extended mode: %v\n", prevExtended)
+			if err := setExtended(ctx, dev, prevExtended); err != nil {
+				warnf("cannot restore extended mode: %v", err)
+			}
+		}
+	}()
+
+	printf("Testing %d MiB of SDRAM (%v mode, extended mode: %v)\n", size/(1024*1024), mode, extended)
+
+	res := jsonMemtest{Size: size, Mode: mode, Extended: extended}
+	var failedBits uint32
+	for i := range memtestPatterns {
+		pat := &memtestPatterns[i]
+		if !pat.quick && !flagMemtestFull {
+			continue
+		}
+		if err := upload(dev, &memtestReader{pat: pat}, size, drive64.BankCARTROM, 0, pat.name+" (write)"); err != nil {
+			return err
+		}
+		chk := &memtestChecker{pat: pat}
+		if err := download(dev, chk, size, drive64.BankCARTROM, 0, pat.name+" (verify)"); err != nil {
+			return err
+		}
+
+		if chk.errors == 0 {
+			printf("%v: OK\n", pat.name)
+		} else {
+			printf("%v: %d errors, failing bits: %032b\n", pat.name, chk.errors, chk.bits)
+			for _, f := range chk.failures {
+				printf("  rom:0x%08x: expected %08x, read %08x (differences: %08x)\n", f.Offset, f.Expected, f.Read, f.Expected^f.Read)
+			}
+			if chk.errors > len(chk.failures) {
+				printf("  ... and %d more\n", chk.errors-len(chk.failures))
+			}
+		}
+		res.Patterns = append(res.Patterns, jsonMemtestPattern{
+			Name:        pat.name,
+			Errors:      chk.errors,
+			FailingBits: fmt.Sprintf("%08x", chk.bits),
+			Failures:    chk.failures,
+		})
+		res.Errors += chk.errors
+		failedBits |= chk.bits
+	}
+
+	emit("memtest", res)
+	if res.Errors > 0 {
+		var bits []string
+		for b := 31; b >= 0; b-- {
+			if failedBits&(1<<b) != 0 {
+				bits = append(bits, fmt.Sprint(b))
+			}
+		}
+		return fmt.Errorf("%w: %d memory errors found (failing data bits: %v)", drive64.ErrIntegrity, res.Errors, strings.Join(bits, ", "))
+	}
+	printf("No errors found\n")
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+// readPattern returns the first size bytes generated for pat, reading them
+// in chunks of the specified size.
+func readPattern(t *testing.T, pat *memtestPattern, size, chunk int) []byte {
+	t.Helper()
+	data := make([]byte, size)
+	r := &memtestReader{pat: pat}
+	for off := 0; off < size; off += chunk {
+		end := off + chunk
+		if end > size {
+			end = size
+		}
+		if _, err := io.ReadFull(r, data[off:end]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return data
+}
+
+func TestMemtestReader(t *testing.T) {
+	for i := range memtestPatterns {
+		pat := &memtestPatterns[i]
+		for _, chunk := range []int{1, 3, 4, 7, 4096} {
+			data := readPattern(t, pat, 4096, chunk)
+			for off := 0; off < len(data); off += 4 {
+				if w, exp := binary.BigEndian.Uint32(data[off:]), pat.word(uint32(off)); w != exp {
+					t.Fatalf("%s (chunk %d): word at 0x%x is %08x, expected %08x", pat.name, chunk, off, w, exp)
+				}
+			}
+		}
+	}
+}
+
+func TestMemtestPatterns(t *testing.T) {
+	// In full mode, each bit of each word is tested both with 0 and 1
+	for i := 0; i < len(memtestPatterns); i += 2 {
+		pat, inv := &memtestPatterns[i], &memtestPatterns[i+1]
+		if !pat.quick || inv.quick {
+			t.Errorf("%s/%s: only the first pattern of each pair is used in quick mode", pat.name, inv.name)
+		}
+		for off := uint32(0); off < 1<<20; off += 4 {
+			if pat.word(off) != ^inv.word(off) {
+				t.Fatalf("%s is not the complement of %s at 0x%x", inv.name, pat.name, off)
+			}
+		}
+	}
+
+	// Walking ones sets each bit once every 32 words
+	var bits uint32
+	for off := uint32(0); off < 32*4; off += 4 {
+		bits |= memtestPatterns[0].word(off)
+	}
+	if bits != 0xFFFFFFFF {
+		t.Errorf("walking ones doesn't set all bits: %08x", bits)
+	}
+
+	// Pseudo-random words differ from their neighbours, so that address
+	// line faults are detected
+	seen := make(map[uint32]bool)
+	for off := uint32(0); off < 1<<16; off += 4 {
+		seen[memtestHash(off)] = true
+	}
+	if len(seen) != 1<<14 {
+		t.Errorf("pseudo-random pattern repeats: %d different words out of %d", len(seen), 1<<14)
+	}
+}
+
+func TestMemtestChecker(t *testing.T) {
+	pat := &memtestPatterns[2] // address-in-address
+	tests := []struct {
+		name    string
+		corrupt func(data []byte)
+		errors  int
+		bits    uint32
+		first   uint32 // offset of the first failure
+	}{
+		{"no errors", func(data []byte) {}, 0, 0, 0},
+		{"stuck bit", func(data []byte) {
+			for off := 0; off < len(data); off += 4 {
+				data[off+3] |= 0x10
+			}
+		}, 2048, 0x10, 0x0},
+		{"flipped byte", func(data []byte) {
+			data[0x1001] ^= 0x81
+		}, 1, 0x810000, 0x1000},
+		{"last word", func(data []byte) {
+			data[len(data)-1] ^= 0x01
+		}, 1, 0x1, 0x3FFC},
+	}
+	for _, tt := range tests {
+		data := readPattern(t, pat, 16*1024, 16*1024)
+		tt.corrupt(data)
+
+		// Write with a chunk size that splits words across writes
+		chk := &memtestChecker{pat: pat}
+		for off := 0; off < len(data); off += 1000 {
+			end := off + 1000
+			if end > len(data) {
+				end = len(data)
+			}
+			if n, err := chk.Write(data[off:end]); err != nil || n != end-off {
+				t.Fatalf("%s: Write: %d, %v", tt.name, n, err)
+			}
+		}
+
+		if chk.errors != tt.errors || chk.bits != tt.bits {
+			t.Errorf("%s: %d errors, failing bits %08x; expected %d, %08x", tt.name, chk.errors, chk.bits, tt.errors, tt.bits)
+		}
+		expFailures := tt.errors
+		if expFailures > memtestMaxFailures {
+			expFailures = memtestMaxFailures
+		}
+		if len(chk.failures) != expFailures {
+			t.Errorf("%s: %d failures reported, expected %d", tt.name, len(chk.failures), expFailures)
+		}
+		if len(chk.failures) > 0 {
+			f := chk.failures[0]
+			if f.Offset != tt.first || f.Expected != pat.word(tt.first) || f.Read != binary.BigEndian.Uint32(data[tt.first:]) {
+				t.Errorf("%s: invalid first failure %+v", tt.name, f)
+			}
+		}
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/rasky/g64drive/drive64"
+)
+
+// Output formats supported by --output
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+var flagOutput string
+
+// jsonOutput returns true if structured JSON output was requested with --output json.
+// In that case, all text output is suppressed (like with --quiet), and commands
+// emit their results as a stream of JSON objects, one per line.
+func jsonOutput() bool {
+	return flagOutput == outputJSON
+}
+
+// jsonRecord is the envelope of every JSON object emitted on stdout.
+// Type identifies the kind of data (eg: "device", "upload", "error").
+type jsonRecord struct {
+	Type string      `json:"type"`
+	Data interface{} `json:"data"`
+}
+
+// emit writes a structured result on stdout, if JSON output is enabled.
+func emit(typ string, data interface{}) {
+	if !jsonOutput() {
+		return
+	}
+	line, err := json.Marshal(jsonRecord{typ, data})
+	if err != nil {
+		// Should never happen: all emitted types are serializable
+		panic(err)
+	}
+	os.Stdout.Write(append(line, '\n'))
+}
+
+// jsonError is the structured representation of an error
+type jsonError struct {
+	Message string `json:"message"`
+	Code    int    `json:"code,omitempty"` // Exit code of the process (see exitCodes)
+}
+
+func emitError(err error) {
+	emit("error", jsonError{Message: err.Error(), Code: exitCode(err)})
+}
+
+// warnf shows a warning: in text mode, it's printed on stdout like any other
+// message; in JSON mode, it's emitted as a "warning" object.
+func warnf(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if jsonOutput() {
+		emit("warning", jsonError{Message: msg})
+		return
+	}
+	fmt.Printf("WARNING: %s\n", msg)
+}
+
+// checkOutputFlag validates --output, and configures the text output accordingly.
+func checkOutputFlag() error {
+	switch flagOutput {
+	case outputText:
+	case outputJSON:
+		flagQuiet = true
+	default:
+		return usageErrorf("invalid output format %q (supported: text, json)", flagOutput)
+	}
+	return nil
+}
+
+// The records emitted by each command are defined below, so that the whole JSON
+// output format can be reviewed in one place.
+
+// jsonDevice describes a 64drive ("device")
+type jsonDevice struct {
+	Index        int    `json:"index"`
+	Manufacturer string `json:"manufacturer,omitempty"`
+	Description  string `json:"description,omitempty"`
+	Serial       string `json:"serial"`
+	Hardware     string `json:"hardware,omitempty"`
+	Firmware     string `json:"firmware,omitempty"`
+	Magic        string `json:"magic,omitempty"`
+
+	Capabilities *jsonCapabilities `json:"capabilities,omitempty"`
+}
+
+// jsonCapabilities describes the features available on a 64drive
+// (see drive64.Capabilities). Features are keyed by drive64.FeatureInfo.Key.
+type jsonCapabilities struct {
+	MaxROMSize int64           `json:"max_rom_size"`
+	SaveTypes  []string        `json:"save_types"`
+	Features   map[string]bool `json:"features"`
+}
+
+func newJSONCapabilities(caps drive64.Capabilities) *jsonCapabilities {
+	jc := &jsonCapabilities{MaxROMSize: caps.MaxROMSize(), Features: map[string]bool{}}
+	for _, st := range caps.SaveTypes() {
+		jc.SaveTypes = append(jc.SaveTypes, st.String())
+	}
+	for _, fi := range drive64.FeatureInfos {
+		jc.Features[fi.Key] = caps.Supports(fi.Feature)
+	}
+	return jc
+}
+
+// jsonTransfer is the result of a download ("download")
+type jsonTransfer struct {
+	File     string `json:"file"`
+	Bank     string `json:"bank"`
+	Offset   uint32 `json:"offset"`
+	Size     int64  `json:"size"`
+	ByteSwap int    `json:"byteswap"`
+}
+
+// jsonUpload is the result of an upload ("upload"). CIC and SaveType are only
+// present if they were automatically configured after the upload.
+type jsonUpload struct {
+	File     string `json:"file"`
+	Bank     string `json:"bank"`
+	Offset   uint32 `json:"offset"`
+	Size     int64  `json:"size"`
+	ByteSwap int    `json:"byteswap"`
+	MD5      string `json:"md5"`
+	CIC      string `json:"cic,omitempty"`
+	SaveType string `json:"save_type,omitempty"`
+	Game     string `json:"game,omitempty"`
+	Extended bool   `json:"extended"`
+}
+
+// jsonConfig reports the configuration changed by cic, savetype and extended ("config")
+type jsonConfig struct {
+	CIC      string `json:"cic,omitempty"`
+	SaveType string `json:"save_type,omitempty"`
+	Extended *bool  `json:"extended,omitempty"`
+}
+
+// jsonFirmware is the metadata of a RPK archive ("firmware")
+type jsonFirmware struct {
+	File     string      `json:"file"`
+	Metadata interface{} `json:"metadata"`
+}
+
+// jsonExtract is the result of firmware extract ("extract")
+type jsonExtract struct {
+	File string `json:"file"`
+	Size int    `json:"size"`
+}
+
+// jsonValidation is the result of firmware validate ("validation")
+type jsonValidation struct {
+	File     string   `json:"file"`
+	Problems []string `json:"problems"`
+}
+
+// jsonUpgradePlan describes an upgrade right before flashing ("upgrade_plan")
+type jsonUpgradePlan struct {
+	Serial  string `json:"serial"`
+	Current string `json:"current"`
+	Type    string `json:"type"`
+	Version string `json:"version"`
+	Date    string `json:"date"`
+	Note    string `json:"note"`
+}
+
+// jsonUpgradeProgress is emitted every time the upgrade progresses ("upgrade_progress")
+type jsonUpgradeProgress struct {
+	Phase   string `json:"phase"`
+	Percent int    `json:"percent"`
+}
+
+// jsonUpgrade is the result of firmware upgrade ("upgrade"). Upgraded is false
+// if the upgrade was aborted, or the device was already up to date.
+type jsonUpgrade struct {
+	Serial   string `json:"serial"`
+	Type     string `json:"type,omitempty"`
+	Version  string `json:"version,omitempty"`
+	Upgraded bool   `json:"upgraded"`
+}
+
+// jsonDebugText is a text packet received by debug ("debug_text")
+type jsonDebugText struct {
+	Text string `json:"text"`
+}
+
+// jsonMemory is the content of a memory range, in hexadecimal ("memory")
+type jsonMemory struct {
+	Bank   string `json:"bank"`
+	Offset uint32 `json:"offset"`
+	Data   string `json:"data"`
+}
+
+// jsonRaw is the result of a raw command ("raw"). Name is set only for known commands.
+type jsonRaw struct {
+	Cmd      uint8    `json:"cmd"`
+	Name     string   `json:"name,omitempty"`
+	Args     []uint32 `json:"args"`
+	Response string   `json:"response"`
+}
+
+// jsonDryRunCmd is a command sent in dry-run mode ("dry_run"). Bank, Offset and
+// Size are set only for transfers.
+type jsonDryRunCmd struct {
+	Cmd      uint8    `json:"cmd"`
+	Name     string   `json:"name"`
+	Args     []uint32 `json:"args,omitempty"`
+	InSize   int      `json:"in_size,omitempty"`
+	OutSize  int      `json:"out_size,omitempty"`
+	Bank     string   `json:"bank,omitempty"`
+	Offset   uint32   `json:"offset,omitempty"`
+	Size     int      `json:"size,omitempty"`
+	Executed bool     `json:"executed,omitempty"`
+}
+
+// jsonDoctorCheck is the result of a check of "doctor" ("doctor")
+type jsonDoctorCheck struct {
+	Name   string `json:"name"`
+	Status string `json:"status"` // ok, info, warn or fail
+	Detail string `json:"detail"`
+	Hint   string `json:"hint,omitempty"`
+}
+
+// jsonMemDiff lists the ranges that differ between two memory images ("diff").
+// Version is only set by save watch.
+type jsonMemDiff struct {
+	Bank    string     `json:"bank"`
+	Time    *time.Time `json:"time,omitempty"`
+	Version int        `json:"version,omitempty"`
+	Ranges  []memRange `json:"ranges"`
+}
+
+// jsonStatus is the configuration recorded for a 64drive ("status"). If Stale is
+// set, the recorded values are the last ones set, but they might not be current.
+type jsonStatus struct {
+	Serial   string     `json:"serial"`
+	Hardware string     `json:"hardware"`
+	Firmware string     `json:"firmware"`
+	Recorded *time.Time `json:"recorded,omitempty"`
+	Stale    string     `json:"stale,omitempty"`
+	CIC      string     `json:"cic,omitempty"`
+	SaveType string     `json:"save_type,omitempty"`
+	Extended *bool      `json:"extended,omitempty"`
+	Rom      *jsonRom   `json:"rom,omitempty"`
+}
+
+type jsonRom struct {
+	Name     string    `json:"name"`
+	MD5      string    `json:"md5"`
+	Size     int64     `json:"size"`
+	Uploaded time.Time `json:"uploaded"`
+	Patched  bool      `json:"patched"`
+}
+
+// jsonSnapshot summarizes a snapshot saved or loaded ("snapshot")
+type jsonSnapshot struct {
+	File        string `json:"file"`
+	Serial      string `json:"serial"`
+	CIC         string `json:"cic"`
+	SaveType    string `json:"save_type"`
+	Extended    bool   `json:"extended"`
+	RomName     string `json:"rom_name,omitempty"`
+	RomMD5      string `json:"rom_md5"`
+	RomSize     int64  `json:"rom_size"`
+	RomIncluded bool   `json:"rom_included"`
+}
+
+func newJSONSnapshot(file string, meta *snapshotMeta) jsonSnapshot {
+	return jsonSnapshot{
+		File:        file,
+		Serial:      meta.Serial,
+		CIC:         meta.CIC.String(),
+		SaveType:    meta.SaveType.String(),
+		Extended:    meta.Extended,
+		RomName:     meta.RomName,
+		RomMD5:      meta.RomMD5,
+		RomSize:     meta.RomSize,
+		RomIncluded: meta.RomIncluded,
+	}
+}
+
+// jsonBench is the result of a benchmark with a link profile ("bench"). Best
+// is set on the profile selected at the end of the benchmark.
+type jsonBench struct {
+	LatencyTimer string  `json:"latency_timer"`
+	ChunkSize    int     `json:"chunk_size"`
+	Upload       float64 `json:"upload"`   // bytes per second
+	Download     float64 `json:"download"` // bytes per second
+	Roundtrip    string  `json:"roundtrip"`
+	Best         bool    `json:"best,omitempty"`
+	Saved        bool    `json:"saved,omitempty"`
+}
+
+func newJSONBench(res *benchResult) jsonBench {
+	return jsonBench{
+		LatencyTimer: res.profile.LatencyTimer.String(),
+		ChunkSize:    res.profile.ChunkSize,
+		Upload:       res.upload,
+		Download:     res.download,
+		Roundtrip:    res.rtt.String(),
+	}
+}
+
+// jsonRun is the result of run ("run")
+type jsonRun struct {
+	Profile  string   `json:"profile"`
+	Rom      string   `json:"rom"`
+	MD5      string   `json:"md5"`
+	Size     int64    `json:"size"`
+	Game     string   `json:"game,omitempty"`
+	CIC      string   `json:"cic,omitempty"`
+	SaveType string   `json:"save_type"`
+	Extended bool     `json:"extended"`
+	Patches  []string `json:"patches,omitempty"`
+	Save     string   `json:"save,omitempty"`
+}
+
+// jsonMemtest is the result of a memory test ("memtest"). Errors is the total
+// number of failing words, across all patterns.
+type jsonMemtest struct {
+	Size     int64                `json:"size"`
+	Mode     string               `json:"mode"` // quick or full
+	Extended bool                 `json:"extended"`
+	Errors   int                  `json:"errors"`
+	Patterns []jsonMemtestPattern `json:"patterns"`
+}
+
+// jsonMemtestPattern is the result of a single pattern of memtest. Failures
+// lists only the first failing words.
+type jsonMemtestPattern struct {
+	Name        string       `json:"name"`
+	Errors      int          `json:"errors"`
+	FailingBits string       `json:"failing_bits"`
+	Failures    []memFailure `json:"failures,omitempty"`
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/rasky/g64drive/drive64"
+	"github.com/spf13/cobra"
+)
+
+var (
+	flagRawIn      string
+	flagRawOutSize sizeUnit
+)
+
+// cmdName describes a command byte, including its name if it's a known command
+func cmdName(c drive64.Cmd) string {
+	if c.Known() {
+		return fmt.Sprintf("0x%02x (%v)", byte(c), c)
+	}
+	return fmt.Sprintf("0x%02x (unknown)", byte(c))
+}
+
+func cmdRaw(cmd *cobra.Command, args []string) error {
+	c, err := drive64.NewCmdFromString(args[0])
+	if err != nil {
+		return usageErrorf("%v", err)
+	}
+	var cmdargs []uint32
+	for _, a := range args[1:] {
+		v, err := strconv.ParseUint(a, 0, 32)
+		if err != nil {
+			return usageErrorf("invalid argument %q (must be a 32-bit number)", a)
+		}
+		cmdargs = append(cmdargs, uint32(v))
+	}
+	var in []byte
+	if flagRawIn != "" {
+		if in, err = ioutil.ReadFile(flagRawIn); err != nil {
+			return err
+		}
+	}
+	if flagRawOutSize.size < 0 {
+		return usageErrorf("invalid size value (negative number)")
+	}
+	out := make([]byte, flagRawOutSize.size)
+
+	dev, err := openDevice()
+	if err != nil {
+		return err
+	}
+	defer dev.Close()
+	vprintf("64drive serial: %v\n", dev.Description().Serial)
+
+	var hexargs []string
+	for _, a := range cmdargs {
+		hexargs = append(hexargs, fmt.Sprintf("%08x", a))
+	}
+	printf("Sending command %v, args: [%v], payload: %d bytes\n", cmdName(c), strings.Join(hexargs, " "), len(in))
+
+	ctx, cancel := cmdContext()
+	defer cancel()
+	if err := dev.SendCmd(ctx, c, cmdargs, in, out); err != nil {
+		return err
+	}
+
+	if jsonOutput() {
+		res := jsonRaw{Cmd: uint8(c), Args: cmdargs, Response: hex.EncodeToString(out)}
+		if c.Known() {
+			res.Name = c.String()
+		}
+		emit("raw", res)
+		return nil
+	}
+	if len(out) == 0 {
+		printf("Command completed\n")
+		return nil
+	}
+	printf("Response (%d bytes):\n", len(out))
+	hexdump(os.Stdout, out, 0)
+	return nil
+}
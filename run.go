@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/rasky/g64drive/drive64"
+	"github.com/spf13/cobra"
+)
+
+var (
+	flagRunProfile  string
+	flagRunRom      string
+	flagRunCic      string
+	flagRunSaveType string
+	flagRunExtended bool
+	flagRunSave     string
+)
+
+func cmdRun(cmd *cobra.Command, args []string) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	p, err := cfg.profile(flagRunProfile)
+	if err != nil {
+		return err
+	}
+
+	// Flags specified on the command line override the profile, which in turn
+	// overrides the defaults of the configuration files.
+	pick := func(flag, profileVal, flagVal string) string {
+		if profileVal == "" || flagOnCommandLine(cmd, flag) {
+			return flagVal
+		}
+		return profileVal
+	}
+	romPath := pick("rom", p.path(p.Rom), flagRunRom)
+	cicName := pick("cic", p.CIC, flagRunCic)
+	stName := pick("savetype", p.SaveType, flagRunSaveType)
+	savePath := pick("save", p.path(p.Save), flagRunSave)
+	extended := p.Extended
+	if cmd.Flags().Changed("extended") && (extended == nil || flagOnCommandLine(cmd, "extended")) {
+		extended = &flagRunExtended
+	}
+	if romPath == "" {
+		return fmt.Errorf("profile %q does not specify a ROM", flagRunProfile)
+	}
+
+	// Validate everything before touching the 64drive
+	var cic drive64.CIC
+	if cicName != "" && cicName != "auto" {
+		if cic, err = drive64.NewCICFromString(cicName); err != nil {
+			return err
+		}
+	}
+	byteswap := -1
+	if p.ByteSwap != nil {
+		byteswap = *p.ByteSwap
+		if byteswap != 0 && byteswap != 2 && byteswap != 4 {
+			return fmt.Errorf("profile %q: invalid byteswap value %d (must be 0, 2 or 4)", flagRunProfile, byteswap)
+		}
+	}
+	var st drive64.SaveType
+	if stName != "" && stName != "auto" {
+		if st, err = drive64.NewSaveTypeFromString(stName); err != nil {
+			return err
+		}
+	}
+	type patch struct {
+		name   string
+		bank   drive64.Bank
+		offset uint32
+		data   []byte
+	}
+	var patches []patch
+	for _, pp := range p.Patches {
+		bank := drive64.BankCARTROM
+		if pp.Bank != "" {
+			if bank, err = drive64.NewBankFromString(pp.Bank); err != nil {
+				return err
+			}
+		}
+		bank, offset, err := parseMemAddress(pp.Offset, bank)
+		if err != nil {
+			return fmt.Errorf("patch %v: %v", pp.File, err)
+		}
+		data, err := ioutil.ReadFile(p.path(pp.File))
+		if err != nil {
+			return err
+		}
+		patches = append(patches, patch{filepath.Base(pp.File), bank, offset, data})
+	}
+	var save []byte
+	if savePath != "" {
+		if save, err = ioutil.ReadFile(savePath); err != nil {
+			return err
+		}
+	}
+
+	rom, size, rommd5, err := openLocalRom(romPath, byteswap)
+	if err != nil {
+		return err
+	}
+	defer rom.Close()
+
+	dev, err := openDevice()
+	if err != nil {
+		return err
+	}
+	defer dev.Close()
+	vprintf("64drive serial: %v\n", dev.Description().Serial)
+
+	ctx, cancel := cmdContext()
+	defer cancel()
+	caps, err := dev.Capabilities(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Like upload, extended mode defaults to true for ROMs larger than 64 MiB
+	ext := size > 64*1024*1024
+	if extended != nil {
+		ext = *extended
+	}
+	extSupported := caps.Supports(drive64.FeatureExtended)
+	if ext && !extSupported {
+		return caps.Check(drive64.FeatureExtended)
+	}
+	if err := drive64.BankCARTROM.Info().CheckRange(caps.Variant, 0, (size+511)&^511); err != nil {
+		return err
+	}
+	if !ext && size > drive64.BankCARTROM.Info().Capacity(caps.Variant, false) {
+		warnf("the ROM is larger than 64 MiB, but extended mode is disabled")
+	}
+	if extSupported {
+		vprintf("Set extended mode: %v\n", ext)
+		if err := setExtended(ctx, dev, ext); err != nil {
+			return err
+		}
+	}
+
+	if err := upload(dev, rom, size, drive64.BankCARTROM, 0, filepath.Base(romPath)); err != nil {
+		return err
+	}
+
+	// The upload might have taken a while, so start a new timeout
+	ctx, cancel = cmdContext()
+	defer cancel()
+	recordRomUpload(ctx, dev, filepath.Base(romPath), rommd5, size)
+
+	res := jsonRun{Profile: flagRunProfile, Rom: romPath, MD5: rommd5, Size: size, Extended: ext}
+
+	if len(patches) > 0 {
+		// Patches are bulk transfers, like the ROM upload
+		err := safeSigIntContext(func(pctx context.Context) error {
+			bfs := make(map[drive64.Bank]*drive64.BankFile)
+			for _, pt := range patches {
+				bf := bfs[pt.bank]
+				if bf == nil {
+					var err error
+					if bf, err = dev.OpenBank(pctx, pt.bank); err != nil {
+						return err
+					}
+					bfs[pt.bank] = bf
+				}
+				vprintf("Patching %v at %v:0x%x (%d bytes)\n", pt.name, pt.bank.Info().Name, pt.offset, len(pt.data))
+				if _, err := bf.WriteAt(pt.data, int64(pt.offset)); err != nil {
+					return fmt.Errorf("patch %v: %w", pt.name, err)
+				}
+				res.Patches = append(res.Patches, pt.name)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// The patches might have taken a while, so start a new timeout
+		ctx, cancel = cmdContext()
+		defer cancel()
+		for _, pt := range patches {
+			if pt.bank == drive64.BankCARTROM {
+				recordRomPatch(ctx, dev)
+				break
+			}
+		}
+	}
+
+	// CIC and save type are detected after patching, as patches might change the header
+	if cicName == "" || cicName == "auto" {
+		if cic, err = cicAutodetect(ctx, dev); err != nil {
+			return err
+		}
+	}
+	vprintf("Set CIC type: %v\n", cic)
+	if err := setCicType(ctx, dev, cic); err != nil {
+		if !errors.Is(err, drive64.ErrUnsupported) {
+			return err
+		}
+		vprintf("Setting CIC not supported on 64drive HW1, skipping\n")
+	} else {
+		res.CIC = cic.String()
+	}
+
+	if stName == "" || stName == "auto" {
+		st, res.Game = autoSaveType(ctx, dev, rommd5)
+	}
+	vprintf("Set save type: %v\n", st)
+	if err := setSaveType(ctx, dev, st); err != nil {
+		return err
+	}
+	res.SaveType = st.String()
+
+	if save != nil {
+		bank, ok := st.Bank()
+		if !ok {
+			return fmt.Errorf("cannot load %v: save type %v has no save memory", savePath, st)
+		}
+		vprintf("Loading save memory from %v\n", savePath)
+		if err := dev.CmdUpload(ctx, bytes.NewReader(save), int64(len(save)), bank, 0); err != nil {
+			return err
+		}
+		res.Save = savePath
+	}
+
+	printf("Profile %v loaded: %v, CIC %v, save type %v, extended %v\n",
+		flagRunProfile, filepath.Base(romPath), cic, st, ext)
+	emit("run", res)
+	return nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rasky/g64drive/drive64"
+	"github.com/spf13/cobra"
+)
+
+var (
+	flagSaveBank     string
+	flagSaveInterval time.Duration
+	flagSaveRecord   string
+)
+
+// saveBank returns the save bank selected with --bank or, by default, the bank
+// of the save type last configured on the device (see setSaveType).
+func saveBank(ctx context.Context, dev *drive64.Device) (drive64.Bank, error) {
+	if flagSaveBank != "" {
+		bank, err := drive64.NewBankFromString(flagSaveBank)
+		if err != nil {
+			return 0, usageErrorf("%v", err)
+		}
+		if !bank.Info().Fixed {
+			return 0, usageErrorf("%v is not a save bank", flagSaveBank)
+		}
+		return bank, nil
+	}
+
+	st, ok := currentState(ctx, dev)
+	if !ok || st.SaveType == nil {
+		return 0, usageErrorf("the save type of the running game is unknown, specify the save bank with --bank (eeprom, sram256, sram768, flash, flash_pokstad2)")
+	}
+	bank, ok := st.SaveType.Bank()
+	if !ok {
+		return 0, usageErrorf("the running game has no save memory (save type: %v), specify the save bank with --bank", *st.SaveType)
+	}
+	vprintf("Save bank: %v (save type: %v)\n", bank.Info().Name, *st.SaveType)
+	return bank, nil
+}
+
+// recordSave writes a version of the save memory in the --record directory
+func recordSave(bank drive64.Bank, version int, data []byte) error {
+	fn := filepath.Join(flagSaveRecord, fmt.Sprintf("%s-%04d.bin", bank.Info().Name, version))
+	if err := ioutil.WriteFile(fn, data, 0666); err != nil {
+		return err
+	}
+	vprintf("Recorded %v\n", fn)
+	return nil
+}
+
+func cmdSaveWatch(cmd *cobra.Command, args []string) error {
+	if flagSaveInterval <= 0 {
+		return usageErrorf("invalid interval")
+	}
+	if flagSaveRecord != "" {
+		if err := os.MkdirAll(flagSaveRecord, 0777); err != nil {
+			return err
+		}
+	}
+
+	dev, err := openDevice()
+	if err != nil {
+		return err
+	}
+	defer dev.Close()
+	vprintf("64drive serial: %v\n", dev.Description().Serial)
+
+	ctx, cancel := cmdContext()
+	defer cancel()
+	bank, err := saveBank(ctx, dev)
+	if err != nil {
+		return err
+	}
+	hwvar, _, _, err := dev.CmdVersionRequest(ctx)
+	if err != nil {
+		return err
+	}
+	size := bank.Info().Capacity(hwvar, false)
+
+	// Save banks are small (2-128 KiB), so a full download at each poll
+	// is cheap and doesn't disturb the running game.
+	poll := func(ctx context.Context) ([]byte, error) {
+		var buf bytes.Buffer
+		if err := dev.CmdDownload(ctx, &buf, size, bank, 0); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	err = safeSigIntContext(func(ctx context.Context) error {
+		cur, err := poll(ctx)
+		if err != nil {
+			return err
+		}
+		version := 0
+		if flagSaveRecord != "" {
+			if err := recordSave(bank, version, cur); err != nil {
+				return err
+			}
+		}
+		printf("Watching %v (%d bytes) every %v, press CTRL+C to stop\n", bank.Info().Name, size, flagSaveInterval)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(flagSaveInterval):
+			}
+
+			next, err := poll(ctx)
+			if err != nil {
+				return err
+			}
+			ranges := memDiff(cur, next, 0)
+			if len(ranges) == 0 {
+				continue
+			}
+
+			version++
+			now := time.Now()
+			emit("diff", jsonMemDiff{Bank: bank.Info().Name, Time: &now, Version: version, Ranges: ranges})
+			printf("[%s] %v changed (version %d, %d range(s)):\n", now.Format("15:04:05.000"),
+				bank.Info().Name, version, len(ranges))
+			if !flagQuiet {
+				printMemDiff(os.Stdout, ranges)
+			}
+			if flagSaveRecord != "" {
+				if err := recordSave(bank, version, next); err != nil {
+					return err
+				}
+			}
+			cur = next
+		}
+	})
+	if errors.Is(err, drive64.ErrAborted) {
+		// Stopping with CTRL+C is the normal way to exit
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/peterh/liner"
+	"github.com/rasky/g64drive/drive64"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// shellDevice is the device kept open by "g64drive shell", shared by all
+// the commands executed in the shell (see openDevice).
+var shellDevice *drive64.Device
+
+type shell struct {
+	root *cobra.Command
+	dev  *drive64.Device
+
+	debugCancel context.CancelFunc // stops the background debug view, if running
+	debugDone   chan struct{}
+}
+
+func cmdShell(cmd *cobra.Command, args []string) error {
+	if shellDevice != nil {
+		return errors.New("already running in a shell")
+	}
+	dev, err := openDevice()
+	if err != nil {
+		return err
+	}
+	defer dev.Close()
+	vprintf("64drive serial: %v\n", dev.Description().Serial)
+
+	sh := &shell{root: newRootCmd(), dev: dev}
+	sh.root.SilenceUsage = true
+
+	// Global flags specified when starting the shell (eg: --output json) become
+	// the defaults of every command executed in the shell.
+	// Flag variables are shared with the new command tree, which reset them.
+	cmd.Root().PersistentFlags().Visit(func(f *pflag.Flag) {
+		if sf := sh.root.PersistentFlags().Lookup(f.Name); sf != nil {
+			sf.DefValue = f.Value.String()
+			sf.Value.Set(sf.DefValue)
+		}
+	})
+	if err := checkOutputFlag(); err != nil {
+		return err
+	}
+
+	shellDevice = dev
+	defer func() { shellDevice = nil }()
+	defer sh.stopDebug()
+
+	// CTRL+C must not kill the shell: it either aborts the current prompt,
+	// or it is handled by the running command (see safeSigIntContext).
+	sigint := make(chan os.Signal, 1)
+	signal.Notify(sigint, os.Interrupt)
+	defer signal.Stop(sigint)
+	go func() {
+		for range sigint {
+		}
+	}()
+
+	if fi, err := os.Stdin.Stat(); err == nil && fi.Mode()&os.ModeCharDevice == 0 {
+		return sh.script(os.Stdin)
+	}
+	return sh.interactive()
+}
+
+// script executes the commands read from r, one per line, stopping at the first error.
+func (sh *shell) script(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		if err := sh.exec(scanner.Text()); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("line %d: %w", n, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// shellHistoryPath returns the path of the file where the shell history is saved
+func shellHistoryPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "g64drive", "shell_history"), nil
+}
+
+func (sh *shell) interactive() error {
+	// The terminal is in raw mode while reading a line, but commands expect
+	// the original mode (eg: for newlines and for reading confirmations).
+	origMode, err := liner.TerminalMode()
+	if err != nil {
+		return err
+	}
+	line := liner.NewLiner()
+	defer line.Close()
+	linerMode, err := liner.TerminalMode()
+	if err != nil {
+		return err
+	}
+	line.SetCtrlCAborts(true)
+	line.SetTabCompletionStyle(liner.TabPrints)
+	line.SetWordCompleter(sh.complete)
+
+	histPath, err := shellHistoryPath()
+	if err == nil {
+		if f, err := os.Open(histPath); err == nil {
+			line.ReadHistory(f)
+			f.Close()
+		}
+		defer func() {
+			os.MkdirAll(filepath.Dir(histPath), 0777)
+			if f, err := os.Create(histPath); err == nil {
+				line.WriteHistory(f)
+				f.Close()
+			}
+		}()
+	}
+
+	printf("64drive shell (serial: %v) -- type \"help\" for the list of commands, \"exit\" to quit\n",
+		sh.dev.Description().Serial)
+	for {
+		text, err := line.Prompt("g64drive> ")
+		if err == liner.ErrPromptAborted {
+			continue
+		} else if err == io.EOF {
+			fmt.Println()
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if strings.TrimSpace(text) != "" {
+			line.AppendHistory(text)
+		}
+
+		origMode.ApplyMode()
+		err = sh.exec(text)
+		linerMode.ApplyMode()
+		if err == io.EOF {
+			return nil
+		} else if err != nil && jsonOutput() {
+			emitError(err)
+		} else if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		}
+	}
+}
+
+// exec executes a line of the shell. It returns io.EOF if the shell must be closed.
+func (sh *shell) exec(text string) error {
+	args, err := splitShellArgs(text)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 || strings.HasPrefix(args[0], "#") {
+		return nil
+	}
+
+	switch args[0] {
+	case "exit", "quit":
+		return io.EOF
+	case "debug":
+		return sh.debug(args[1:])
+	}
+
+	// Flags keep their values across executions, so reset all of them
+	defer resetFlags(sh.root)
+	sh.root.SetArgs(args)
+	sh.root.SilenceErrors = true
+	return sh.root.Execute()
+}
+
+// resetFlags sets all the flags of cmd and its subcommands back to their default values
+func resetFlags(cmd *cobra.Command) {
+	reset := func(f *pflag.Flag) {
+		f.Value.Set(f.DefValue)
+		f.Changed = false
+		delete(f.Annotations, configDefaultAnnotation)
+	}
+	cmd.Flags().VisitAll(reset)
+	cmd.PersistentFlags().VisitAll(reset)
+	for _, c := range cmd.Commands() {
+		resetFlags(c)
+	}
+}
+
+// debug starts or stops the background debug view, which shows the text
+// printed by the running program (see "g64drive debug").
+func (sh *shell) debug(args []string) error {
+	switch {
+	case len(args) == 0:
+		if sh.debugRunning() {
+			printf("Debug view is running\n")
+		} else {
+			printf("Debug view is stopped\n")
+		}
+		return nil
+	case len(args) == 1 && args[0] == "on":
+		if sh.debugRunning() {
+			return nil
+		}
+		sh.stopDebug()
+		ctx, cmdcancel := cmdContext()
+		caps, err := sh.dev.Capabilities(ctx)
+		cmdcancel()
+		if err != nil {
+			return err
+		} else if err := caps.Check(drive64.FeatureDebugFifo); err != nil {
+			return err
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		sh.debugCancel, sh.debugDone = cancel, make(chan struct{})
+		go sh.debugLoop(ctx, sh.debugDone)
+		return nil
+	case len(args) == 1 && args[0] == "off":
+		sh.stopDebug()
+		return nil
+	default:
+		return errors.New("usage: debug [on|off]")
+	}
+}
+
+// debugRunning returns true if the debug view is running (it stops by itself
+// in case of errors).
+func (sh *shell) debugRunning() bool {
+	if sh.debugCancel == nil {
+		return false
+	}
+	select {
+	case <-sh.debugDone:
+		return false
+	default:
+		return true
+	}
+}
+
+func (sh *shell) stopDebug() {
+	if sh.debugCancel != nil {
+		sh.debugCancel()
+		<-sh.debugDone
+		sh.debugCancel, sh.debugDone = nil, nil
+	}
+}
+
+func (sh *shell) debugLoop(ctx context.Context, done chan struct{}) {
+	defer close(done)
+	for ctx.Err() == nil {
+		typ, data, err := sh.dev.CmdFifoRead(ctx)
+		if err != nil {
+			if errors.Is(err, drive64.ErrInvalidFifoHead) || ctx.Err() != nil {
+				continue
+			}
+			fmt.Fprintf(os.Stderr, "\r\ndebug view stopped: %v\r\n", err)
+			return
+		}
+		if typ != 1 {
+			// ignoring unknown packet type
+			continue
+		}
+		data = bytes.TrimRight(data, "\000")
+		if jsonOutput() {
+			emit("debug_text", jsonDebugText{Text: string(data)})
+		} else {
+			// The terminal might be in raw mode (while the prompt is shown)
+			os.Stdout.Write(bytes.ReplaceAll(data, []byte("\n"), []byte("\r\n")))
+		}
+	}
+}
+
+// splitShellArgs splits a command line into arguments, honoring single and
+// double quotes, and backslash escapes.
+func splitShellArgs(text string) ([]string, error) {
+	var args []string
+	var cur strings.Builder
+	inArg := false
+	var quote rune
+	escape := false
+	for _, c := range text {
+		switch {
+		case escape:
+			cur.WriteRune(c)
+			escape = false
+		case c == '\\' && quote != '\'':
+			escape, inArg = true, true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				cur.WriteRune(c)
+			}
+		case c == '\'' || c == '"':
+			quote, inArg = c, true
+		case c == ' ' || c == '\t':
+			if inArg {
+				args = append(args, cur.String())
+				cur.Reset()
+				inArg = false
+			}
+		default:
+			cur.WriteRune(c)
+			inArg = true
+		}
+	}
+	if quote != 0 || escape {
+		return nil, errors.New("unterminated quote or escape")
+	}
+	if inArg {
+		args = append(args, cur.String())
+	}
+	return args, nil
+}
+
+// complete implements tab completion: command names, flag names, values of
+// flags and positional arguments (banks, CIC variants, save types) and files.
+func (sh *shell) complete(line string, pos int) (head string, completions []string, tail string) {
+	head, tail = line[:pos], line[pos:]
+	words := strings.Fields(head)
+	word := ""
+	if len(words) > 0 && !strings.HasSuffix(head, " ") {
+		word, words = words[len(words)-1], words[:len(words)-1]
+	}
+	head = head[:len(head)-len(word)]
+
+	var candidates []string
+	cmd, rest, err := sh.root.Find(words)
+	switch {
+	case len(words) == 0:
+		candidates = append(commandNames(sh.root), "exit", "quit")
+	case err != nil:
+	case words[0] == "debug":
+		candidates = []string{"on", "off"}
+	case strings.HasPrefix(word, "-"):
+		cmd.Flags().VisitAll(func(f *pflag.Flag) { candidates = append(candidates, "--"+f.Name) })
+		cmd.InheritedFlags().VisitAll(func(f *pflag.Flag) { candidates = append(candidates, "--"+f.Name) })
+	case len(words) > 0 && strings.HasPrefix(words[len(words)-1], "-") && shellFlagValues(cmd, words[len(words)-1], word) != nil:
+		candidates = shellFlagValues(cmd, words[len(words)-1], word)
+	case cmd.HasSubCommands() && len(rest) == 0:
+		candidates = commandNames(cmd)
+	case cmd.ValidArgsFunction != nil:
+		// Same completion used by the shell completion scripts
+		values, dir := cmd.ValidArgsFunction(cmd, positionalArgs(cmd, rest), word)
+		if dir&cobra.ShellCompDirectiveFilterFileExt != 0 {
+			candidates = globFiles(word, values)
+		} else {
+			candidates = values
+		}
+	default:
+		candidates = globFiles(word, nil)
+	}
+
+	for _, c := range candidates {
+		if strings.HasPrefix(c, word) {
+			completions = append(completions, c)
+		}
+	}
+	sort.Strings(completions)
+	return
+}
+
+// commandNames returns the names of the subcommands of cmd
+func commandNames(cmd *cobra.Command) []string {
+	var names []string
+	for _, c := range cmd.Commands() {
+		if c.IsAvailableCommand() && c.Name() != "shell" {
+			names = append(names, c.Name())
+		}
+	}
+	return names
+}
+
+// shellFlagValues returns the possible values of the specified flag of cmd
+// (see flagCompletions), or nil if they cannot be completed.
+func shellFlagValues(cmd *cobra.Command, flag string, word string) []string {
+	var f *pflag.Flag
+	if strings.HasPrefix(flag, "--") {
+		f = cmd.Flags().Lookup(flag[2:])
+	} else if len(flag) == 2 {
+		f = cmd.Flags().ShorthandLookup(flag[1:])
+	}
+	if f == nil {
+		return nil
+	}
+	if values, found := flagCompletions[f.Name]; found {
+		return values()
+	}
+	if exts, found := flagFileCompletions[f.Name]; found {
+		return globFiles(word, exts)
+	}
+	return nil
+}
+
+// positionalArgs removes the flags (and their values) from args
+func positionalArgs(cmd *cobra.Command, args []string) []string {
+	var pos []string
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		if !strings.HasPrefix(a, "-") || a == "-" {
+			pos = append(pos, a)
+			continue
+		}
+		var f *pflag.Flag
+		if strings.HasPrefix(a, "--") {
+			f = cmd.Flags().Lookup(strings.SplitN(a[2:], "=", 2)[0])
+		} else if len(a) == 2 {
+			f = cmd.Flags().ShorthandLookup(a[1:])
+		}
+		// Skip the value of flags that take one, unless specified with "="
+		if f != nil && f.NoOptDefVal == "" && !strings.Contains(a, "=") {
+			i++
+		}
+	}
+	return pos
+}
+
+// globFiles returns the directories and the files (with one of the specified
+// extensions, if any) whose path starts with prefix.
+func globFiles(prefix string, exts []string) []string {
+	matches, _ := filepath.Glob(prefix + "*")
+	var res []string
+	for _, m := range matches {
+		if fi, err := os.Stat(m); err == nil && fi.IsDir() {
+			res = append(res, m+string(filepath.Separator))
+			continue
+		}
+		if len(exts) == 0 {
+			res = append(res, m)
+			continue
+		}
+		for _, ext := range exts {
+			if strings.EqualFold(filepath.Ext(m), "."+ext) {
+				res = append(res, m)
+				break
+			}
+		}
+	}
+	return res
+}
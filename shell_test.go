@@ -0,0 +1,42 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitShellArgs(t *testing.T) {
+	tests := []struct {
+		text string
+		args []string
+		err  bool
+	}{
+		{"", nil, false},
+		{"   \t ", nil, false},
+		{"list", []string{"list"}, false},
+		{"  upload  -b  sram256\tsave.srm ", []string{"upload", "-b", "sram256", "save.srm"}, false},
+		{`upload "my rom.z64"`, []string{"upload", "my rom.z64"}, false},
+		{`upload 'my rom.z64'`, []string{"upload", "my rom.z64"}, false},
+		{`upload my\ rom.z64`, []string{"upload", "my rom.z64"}, false},
+		{`upload dir/"my rom".z64`, []string{"upload", "dir/my rom.z64"}, false},
+		{`echo "it's"`, []string{"echo", "it's"}, false},
+		{`echo 'say "hi"'`, []string{"echo", `say "hi"`}, false},
+		{`echo "a \"b\" c"`, []string{"echo", `a "b" c`}, false},
+		{`echo 'a\b'`, []string{"echo", `a\b`}, false},
+		{`echo \\`, []string{"echo", `\`}, false},
+		{`echo "" ''`, []string{"echo", "", ""}, false},
+		{`upload "my rom.z64`, nil, true},
+		{`upload 'my rom.z64`, nil, true},
+		{`upload rom\`, nil, true},
+	}
+	for _, tt := range tests {
+		args, err := splitShellArgs(tt.text)
+		if (err != nil) != tt.err {
+			t.Errorf("%q: error %v, expected error: %v", tt.text, err, tt.err)
+			continue
+		}
+		if !reflect.DeepEqual(args, tt.args) {
+			t.Errorf("%q: got %q, expected %q", tt.text, args, tt.args)
+		}
+	}
+}
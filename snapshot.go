@@ -0,0 +1,413 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rasky/g64drive/drive64"
+	"github.com/spf13/cobra"
+)
+
+var (
+	flagSnapCic      string
+	flagSnapSaveType string
+	flagSnapExtended bool
+	flagSnapRom      string
+	flagSnapRomSize  sizeUnit
+)
+
+// Names of the entries within a snapshot archive
+const (
+	snapMetaName = "snapshot.json"
+	snapRomName  = "rom.z64"
+	snapSaveName = "save.bin"
+)
+
+// snapshotVersion is the version of the snapshot format written by this g64drive
+const snapshotVersion = 1
+
+// snapshotMeta describes the contents of a snapshot archive. The 64drive cannot
+// report its current configuration, so the CIC, save type and extended mode
+// are the ones specified when the snapshot was taken.
+type snapshotMeta struct {
+	Version  int
+	Created  time.Time
+	Serial   string
+	Hardware string
+	Firmware string
+
+	CIC      drive64.CIC
+	SaveType drive64.SaveType
+	Extended bool
+
+	RomName     string // Name of the ROM file, if the ROM is not included
+	RomMD5      string // MD5 of the ROM contents (big-endian)
+	RomSize     int64
+	RomIncluded bool
+}
+
+// openLocalRom opens a ROM file, and returns a reader to its big-endian
+// contents and its MD5, which is computed like "g64drive upload" does.
+// The byteswap format is autodetected from the ROM header if byteswap is -1.
+func openLocalRom(path string, byteswap int) (io.ReadCloser, int64, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, "", err
+	}
+
+	bs := drive64.ByteSwapper(byteswap)
+	if byteswap < 0 {
+		var magic [4]byte
+		f.ReadAt(magic[:], 0)
+		if bs, err = drive64.ByteSwapDetect(magic[:]); err != nil {
+			f.Close()
+			return nil, 0, "", err
+		}
+	}
+
+	h := md5.New()
+	if _, err := io.Copy(h, bs.NewReader(f)); err != nil {
+		f.Close()
+		return nil, 0, "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return nil, 0, "", err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{bs.NewReader(f), f}, fi.Size(), hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func cmdSnapshotSave(cmd *cobra.Command, args []string) error {
+	var st drive64.SaveType
+	var err error
+	if flagSnapSaveType != "" {
+		if st, err = drive64.NewSaveTypeFromString(flagSnapSaveType); err != nil {
+			return usageErrorf("%v", err)
+		}
+	}
+	if flagSnapRomSize.size < 0 {
+		return usageErrorf("invalid size value (negative number)")
+	}
+	var cic drive64.CIC
+	if flagSnapCic != "auto" {
+		if cic, err = drive64.NewCICFromString(flagSnapCic); err != nil {
+			return usageErrorf("%v", err)
+		}
+	}
+
+	dev, err := openDevice()
+	if err != nil {
+		return err
+	}
+	defer dev.Close()
+	vprintf("64drive serial: %v\n", dev.Description().Serial)
+
+	ctx, cancel := cmdContext()
+	defer cancel()
+	hwvar, fwver, _, err := dev.CmdVersionRequest(ctx)
+	if err != nil {
+		return err
+	}
+	if flagSnapCic == "auto" {
+		if cic, err = cicAutodetect(ctx, dev); err != nil {
+			return err
+		}
+		vprintf("Detected CIC type: %v\n", cic)
+	}
+
+	// The save type, the extended mode and the ROM size default to the ones
+	// recorded when the 64drive was configured (see "g64drive status").
+	state, known := currentState(ctx, dev)
+	if flagSnapSaveType == "" {
+		if !known || state.SaveType == nil {
+			return usageErrorf("the save type of the 64drive is unknown, specify it with --savetype")
+		}
+		st = *state.SaveType
+		vprintf("Save type: %v\n", st)
+	}
+	extended := flagSnapExtended
+	if !cmd.Flags().Changed("extended") && known && state.Extended != nil {
+		extended = *state.Extended
+		vprintf("Extended mode: %v\n", extended)
+	}
+
+	meta := snapshotMeta{
+		Version:  snapshotVersion,
+		Created:  time.Now().UTC(),
+		Serial:   dev.Description().Serial,
+		Hardware: hwvar.String(),
+		Firmware: fwver.String(),
+		CIC:      cic,
+		SaveType: st,
+		Extended: extended,
+	}
+
+	// Dump the ROM contents, unless the ROM is available locally. In that case,
+	// make sure that it matches what is loaded on the 64drive.
+	var rom bytes.Buffer
+	if flagSnapRom != "" {
+		r, size, md5sum, err := openLocalRom(flagSnapRom, -1)
+		if err != nil {
+			return err
+		}
+		r.Close()
+		meta.RomName, meta.RomMD5, meta.RomSize = filepath.Base(flagSnapRom), md5sum, size
+
+		// Transfers are padded to 512 bytes, but CmdDownload only writes the requested bytes
+		if err := drive64.BankCARTROM.Info().CheckRange(hwvar, 0, (size+511)&^511); err != nil {
+			return err
+		}
+		h := md5.New()
+		if err := download(dev, h, size, drive64.BankCARTROM, 0, "verify ROM"); err != nil {
+			return err
+		}
+		if hex.EncodeToString(h.Sum(nil)) != md5sum {
+			return fmt.Errorf("%v does not match the ROM loaded on the 64drive", flagSnapRom)
+		}
+	} else {
+		size := flagSnapRomSize.size
+		if size == 0 && known && state.Rom != nil {
+			size = state.Rom.Size
+			vprintf("ROM size: %v\n", size)
+		}
+		if size == 0 {
+			size = drive64.BankCARTROM.Info().Capacity(hwvar, extended)
+			vprintf("ROM size unknown, saving the whole bank (%v)\n", size)
+		}
+		if err := drive64.BankCARTROM.Info().CheckRange(hwvar, 0, (size+511)&^511); err != nil {
+			return err
+		}
+		if err := download(dev, &rom, size, drive64.BankCARTROM, 0, "ROM"); err != nil {
+			return err
+		}
+		sum := md5.Sum(rom.Bytes())
+		meta.RomMD5, meta.RomSize, meta.RomIncluded = hex.EncodeToString(sum[:]), size, true
+	}
+
+	var save bytes.Buffer
+	if bank, ok := st.Bank(); ok {
+		size := bank.Info().Capacity(hwvar, false)
+		if err := download(dev, &save, size, bank, 0, "save"); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.Create(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	zw := zip.NewWriter(f)
+	metadata, err := json.MarshalIndent(&meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	entries := []struct {
+		name string
+		data []byte
+	}{
+		{snapMetaName, metadata},
+		{snapRomName, rom.Bytes()},
+		{snapSaveName, save.Bytes()},
+	}
+	for _, e := range entries {
+		if e.name != snapMetaName && len(e.data) == 0 {
+			continue
+		}
+		w, err := zw.Create(e.name)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(e.data); err != nil {
+			return err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	printf("Snapshot saved: CIC %v, save type %v, extended %v, ROM md5 %v\n", meta.CIC, meta.SaveType, meta.Extended, meta.RomMD5)
+	emit("snapshot", newJSONSnapshot(args[0], &meta))
+	return nil
+}
+
+// readSnapshot opens a snapshot archive and parses its metadata
+func readSnapshot(path string) (*zip.ReadCloser, *snapshotMeta, error) {
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := readSnapshotEntry(zr, snapMetaName)
+	if err != nil {
+		zr.Close()
+		return nil, nil, err
+	}
+	var meta snapshotMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		zr.Close()
+		return nil, nil, fmt.Errorf("%v: invalid snapshot metadata: %v", path, err)
+	}
+	if meta.Version > snapshotVersion {
+		zr.Close()
+		return nil, nil, fmt.Errorf("%v: unsupported snapshot version %d, please upgrade g64drive", path, meta.Version)
+	}
+	return zr, &meta, nil
+}
+
+func readSnapshotEntry(zr *zip.ReadCloser, name string) ([]byte, error) {
+	for _, zf := range zr.File {
+		if zf.Name == name {
+			r, err := zf.Open()
+			if err != nil {
+				return nil, err
+			}
+			defer r.Close()
+			return ioutil.ReadAll(r)
+		}
+	}
+	return nil, fmt.Errorf("snapshot is corrupted: missing %v", name)
+}
+
+func cmdSnapshotLoad(cmd *cobra.Command, args []string) error {
+	zr, meta, err := readSnapshot(args[0])
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	vprintf("Snapshot created on %v from 64drive %v (%v, firmware %v)\n",
+		meta.Created.Local().Format(time.RFC1123), meta.Serial, meta.Hardware, meta.Firmware)
+
+	// Find the ROM contents: either within the snapshot, or in a local file
+	// which must match the MD5 recorded in the snapshot.
+	var rom io.Reader
+	if meta.RomIncluded {
+		data, err := readSnapshotEntry(zr, snapRomName)
+		if err != nil {
+			return err
+		}
+		if int64(len(data)) != meta.RomSize {
+			return fmt.Errorf("snapshot is corrupted: %v is %d bytes, expected %d", snapRomName, len(data), meta.RomSize)
+		}
+		rom = bytes.NewReader(data)
+	} else {
+		path := flagSnapRom
+		if path == "" {
+			// Look for the ROM next to the snapshot
+			path = filepath.Join(filepath.Dir(args[0]), meta.RomName)
+		}
+		r, size, md5sum, err := openLocalRom(path, -1)
+		if os.IsNotExist(err) && flagSnapRom == "" {
+			return fmt.Errorf("the snapshot does not include the ROM; specify the path of %v with --rom", meta.RomName)
+		} else if err != nil {
+			return err
+		}
+		defer r.Close()
+		if size != meta.RomSize || md5sum != meta.RomMD5 {
+			return fmt.Errorf("%v does not match the ROM of the snapshot (md5: %v)", path, meta.RomMD5)
+		}
+		rom = r
+	}
+
+	var save []byte
+	bank, hasSave := meta.SaveType.Bank()
+	if hasSave {
+		if save, err = readSnapshotEntry(zr, snapSaveName); err != nil {
+			return err
+		}
+	}
+
+	dev, err := openDevice()
+	if err != nil {
+		return err
+	}
+	defer dev.Close()
+	vprintf("64drive serial: %v\n", dev.Description().Serial)
+
+	ctx, cancel := cmdContext()
+	defer cancel()
+	caps, err := dev.Capabilities(ctx)
+	if err != nil {
+		return err
+	}
+	extSupported := caps.Supports(drive64.FeatureExtended)
+	if meta.Extended && !extSupported {
+		return fmt.Errorf("the snapshot requires extended mode: %w", caps.Check(drive64.FeatureExtended))
+	}
+	if err := drive64.BankCARTROM.Info().CheckRange(caps.Variant, 0, (meta.RomSize+511)&^511); err != nil {
+		return err
+	}
+	if hasSave {
+		if err := bank.Info().CheckRange(caps.Variant, 0, (int64(len(save))+511)&^511); err != nil {
+			return fmt.Errorf("snapshot is corrupted: %v: %w", snapSaveName, err)
+		}
+	}
+
+	// Extended mode changes the memory layout, so it must be set before the upload
+	if extSupported {
+		vprintf("Set extended mode: %v\n", meta.Extended)
+		if err := setExtended(ctx, dev, meta.Extended); err != nil {
+			return err
+		}
+	}
+
+	if err := upload(dev, rom, meta.RomSize, drive64.BankCARTROM, 0, "ROM"); err != nil {
+		return err
+	}
+
+	// The upload might have taken a while, so start a new timeout
+	ctx, cancel = cmdContext()
+	defer cancel()
+
+	romName := meta.RomName
+	if meta.RomIncluded {
+		romName = filepath.Base(args[0])
+	}
+	recordRomUpload(ctx, dev, romName, meta.RomMD5, meta.RomSize)
+
+	vprintf("Set CIC type: %v\n", meta.CIC)
+	if err := setCicType(ctx, dev, meta.CIC); err != nil {
+		if errors.Is(err, drive64.ErrUnsupported) {
+			vprintf("Setting CIC not supported on 64drive HW1, skipping\n")
+		} else {
+			return err
+		}
+	}
+	vprintf("Set save type: %v\n", meta.SaveType)
+	if err := setSaveType(ctx, dev, meta.SaveType); err != nil {
+		return err
+	}
+
+	// Restore the save memory after the save type is configured
+	if hasSave {
+		if err := safeSigIntContext(func(ctx context.Context) error {
+			return dev.CmdUpload(ctx, bytes.NewReader(save), int64(len(save)), bank, 0)
+		}); err != nil {
+			return err
+		}
+	}
+
+	printf("Snapshot loaded: CIC %v, save type %v, extended %v\n", meta.CIC, meta.SaveType, meta.Extended)
+	emit("snapshot", newJSONSnapshot(args[0], meta))
+	return nil
+}
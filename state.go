@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rasky/g64drive/drive64"
+	"github.com/spf13/cobra"
+)
+
+// The 64drive cannot report which CIC, save type and extended mode are active,
+// so g64drive records the last values it configured on each device (indexed by
+// serial), together with the last ROM it uploaded.
+//
+// The device forgets its configuration when it is power-cycled or upgraded, so
+// the recorded state comes with a fingerprint of the device at the time it was
+// recorded: the firmware version and the MD5 of the ROM header. If either of them
+// changed, the state might be stale.
+
+// Size of the beginning of CARTROM used as fingerprint of the loaded ROM
+const stateHeaderSize = 0x1000
+
+type romState struct {
+	Name    string
+	MD5     string
+	Size    int64
+	Time    time.Time
+	Patched bool // The ROM was modified by a later upload
+}
+
+type deviceState struct {
+	Firmware  string // Firmware version when the state was recorded
+	HeaderMD5 string // MD5 of the ROM header when the state was recorded
+	Updated   time.Time
+
+	CIC      *drive64.CIC
+	SaveType *drive64.SaveType
+	Extended *bool
+	Rom      *romState
+}
+
+// statePath returns the path of the file where the device states are saved.
+func statePath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "g64drive", "state.json"), nil
+}
+
+// loadStates loads the recorded device states, indexed by device serial.
+func loadStates() (map[string]deviceState, error) {
+	states := make(map[string]deviceState)
+	path, err := statePath()
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return states, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &states); err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	return states, nil
+}
+
+func saveStates(states map[string]deviceState) error {
+	path, err := statePath()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(states, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0666)
+}
+
+// deviceFingerprint returns the firmware version and the MD5 of the ROM header
+// currently loaded on the device.
+func deviceFingerprint(ctx context.Context, dev *drive64.Device) (string, string, error) {
+	_, fwver, _, err := dev.CmdVersionRequest(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	var header bytes.Buffer
+	if err := dev.CmdDownload(ctx, &header, stateHeaderSize, drive64.BankCARTROM, 0); err != nil {
+		return "", "", err
+	}
+	sum := md5.Sum(header.Bytes())
+	return fwver.String(), hex.EncodeToString(sum[:]), nil
+}
+
+// recordState updates the recorded state of the device with the function f.
+// If the previous state is stale, it is discarded first; romChanged must be true
+// if the caller just modified the ROM, so that the header is not used to detect it.
+// Failing to record the state is not fatal, so errors are only reported in verbose mode.
+func recordState(ctx context.Context, dev *drive64.Device, romChanged bool, f func(st *deviceState)) {
+	if err := func() error {
+		states, err := loadStates()
+		if err != nil {
+			return err
+		}
+		fw, hdr, err := deviceFingerprint(ctx, dev)
+		if err != nil {
+			return err
+		}
+
+		serial := dev.Description().Serial
+		st := states[serial]
+		if st.Firmware != fw || (!romChanged && st.HeaderMD5 != hdr) {
+			st = deviceState{}
+		}
+		f(&st)
+		st.Firmware, st.HeaderMD5, st.Updated = fw, hdr, time.Now()
+		states[serial] = st
+		if dev.IsDryRun() {
+			// The device state is read like in a normal run, but nothing is changed
+			return nil
+		}
+		return saveStates(states)
+	}(); err != nil {
+		vprintf("cannot record device state: %v\n", err)
+	}
+}
+
+// currentState returns the state recorded for the device, if it is still valid
+// (see cmdStatus for the rules).
+func currentState(ctx context.Context, dev *drive64.Device) (deviceState, bool) {
+	states, err := loadStates()
+	if err != nil {
+		return deviceState{}, false
+	}
+	fw, hdr, err := deviceFingerprint(ctx, dev)
+	if err != nil {
+		return deviceState{}, false
+	}
+	st, found := states[dev.Description().Serial]
+	if !found || st.Firmware != fw || st.HeaderMD5 != hdr {
+		return deviceState{}, false
+	}
+	return st, true
+}
+
+// setCicType configures the CIC and records it in the device state
+func setCicType(ctx context.Context, dev *drive64.Device, cic drive64.CIC) error {
+	if err := dev.CmdSetCicType(ctx, cic); err != nil {
+		return err
+	}
+	recordState(ctx, dev, false, func(st *deviceState) { st.CIC = &cic })
+	return nil
+}
+
+// setSaveType configures the save type and records it in the device state
+func setSaveType(ctx context.Context, dev *drive64.Device, savetype drive64.SaveType) error {
+	if err := dev.CmdSetSaveType(ctx, savetype); err != nil {
+		return err
+	}
+	recordState(ctx, dev, false, func(st *deviceState) { st.SaveType = &savetype })
+	return nil
+}
+
+// setExtended configures the extended mode and records it in the device state
+func setExtended(ctx context.Context, dev *drive64.Device, extended bool) error {
+	if err := dev.CmdSetExtended(ctx, extended); err != nil {
+		return err
+	}
+	recordState(ctx, dev, false, func(st *deviceState) { st.Extended = &extended })
+	return nil
+}
+
+// recordRomUpload records a ROM uploaded at the beginning of CARTROM
+func recordRomUpload(ctx context.Context, dev *drive64.Device, name string, md5sum string, size int64) {
+	recordState(ctx, dev, true, func(st *deviceState) {
+		st.Rom = &romState{Name: name, MD5: md5sum, Size: size, Time: time.Now()}
+	})
+}
+
+// recordRomPatch records that the ROM was modified by a partial upload
+func recordRomPatch(ctx context.Context, dev *drive64.Device) {
+	recordState(ctx, dev, true, func(st *deviceState) {
+		if st.Rom != nil {
+			st.Rom.Patched = true
+		}
+	})
+}
+
+func cmdStatus(cmd *cobra.Command, args []string) error {
+	dev, err := openDevice()
+	if err != nil {
+		return err
+	}
+	defer dev.Close()
+	serial := dev.Description().Serial
+
+	ctx, cancel := cmdContext()
+	defer cancel()
+	hwvar, fwver, _, err := dev.CmdVersionRequest(ctx)
+	if err != nil {
+		return err
+	}
+	fw, hdr, err := deviceFingerprint(ctx, dev)
+	if err != nil {
+		return err
+	}
+
+	states, err := loadStates()
+	if err != nil {
+		return err
+	}
+	st, found := states[serial]
+
+	printf("64drive serial: %v\n", serial)
+	printf("Hardware: %v, Firmware: %v\n", hwvar, fwver)
+
+	stale := ""
+	switch {
+	case !found:
+		stale = "never configured by g64drive"
+	case st.Firmware != fw:
+		stale = fmt.Sprintf("firmware changed from %v", st.Firmware)
+	case st.HeaderMD5 != hdr:
+		stale = "ROM header changed, the 64drive was probably power-cycled or used by another tool"
+	}
+	if found {
+		printf("State recorded: %v\n", st.Updated.Local().Format(time.RFC1123))
+	}
+	if stale != "" {
+		printf("State unknown: %v\n", stale)
+	}
+
+	// show prints a recorded value, or unknown (with the last known value, if any)
+	show := func(name string, val interface{}, valid bool) {
+		switch {
+		case !valid:
+			printf("%-15s unknown\n", name+":")
+		case stale != "":
+			printf("%-15s unknown (last set: %v)\n", name+":", val)
+		default:
+			printf("%-15s %v\n", name+":", val)
+		}
+	}
+	var cic, savetype, extended interface{}
+	if st.CIC != nil {
+		cic = *st.CIC
+	}
+	if st.SaveType != nil {
+		savetype = *st.SaveType
+	}
+	if st.Extended != nil {
+		extended = *st.Extended
+	}
+	show("CIC", cic, st.CIC != nil)
+	show("Save type", savetype, st.SaveType != nil)
+	show("Extended mode", extended, st.Extended != nil)
+
+	var rom string
+	if st.Rom != nil {
+		rom = fmt.Sprintf("%v (md5: %v, size: %d, uploaded: %v)", st.Rom.Name, st.Rom.MD5, st.Rom.Size,
+			st.Rom.Time.Local().Format(time.RFC1123))
+		if st.Rom.Patched {
+			rom += ", modified after upload"
+		}
+	}
+	show("ROM", rom, st.Rom != nil)
+
+	res := jsonStatus{Serial: serial, Hardware: hwvar.String(), Firmware: fwver.String(), Stale: stale}
+	if found {
+		res.Recorded = &st.Updated
+	}
+	if st.CIC != nil {
+		res.CIC = st.CIC.String()
+	}
+	if st.SaveType != nil {
+		res.SaveType = st.SaveType.String()
+	}
+	res.Extended = st.Extended
+	if st.Rom != nil {
+		res.Rom = &jsonRom{st.Rom.Name, st.Rom.MD5, st.Rom.Size, st.Rom.Time, st.Rom.Patched}
+	}
+	emit("status", res)
+	return nil
+}